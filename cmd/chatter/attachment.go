@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// attachmentChunkSize is the size of the chunks attachments are streamed in
+	attachmentChunkSize = 32 * 1024
+
+	maxAttachmentsPerMessage = 10
+)
+
+// sanitizeAttachmentName keeps only the last element of a path a client gave as the name of an attachment, so it can't point
+// anywhere when it's saved, and is empty if there's nothing left.
+func sanitizeAttachmentName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" {
+		return ""
+	}
+	return name
+}
+
+func (s *ChatServerCmd) UploadAttachment(server pb.ChatServer_UploadAttachmentServer) error {
+	first, err := server.Recv()
+	if err != nil {
+		return err
+	}
+	info := first.GetInfo()
+	if info == nil {
+		return status.Error(codes.InvalidArgument, "the first message of an upload has to be its info")
+	}
+	if info.Size > s.MaxAttachmentSize {
+		return status.Errorf(codes.InvalidArgument, "attachments can't be larger than %d bytes", s.MaxAttachmentSize)
+	}
+	name := sanitizeAttachmentName(info.Name)
+
+	w, err := s.blobs.create()
+	if err != nil {
+		s.logger.Error("failed to store attachment", "err", err)
+		return status.Error(codes.Internal, "failed to store attachment")
+	}
+	defer w.abort()
+	for {
+		request, err := server.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if request.GetInfo() != nil {
+			return status.Error(codes.InvalidArgument, "an upload can only have one info")
+		}
+		if _, err := w.Write(request.GetChunk()); err != nil {
+			if errors.Is(err, errBlobTooLarge) {
+				return status.Errorf(codes.InvalidArgument, "attachments can't be larger than %d bytes", s.MaxAttachmentSize)
+			}
+			s.logger.Error("failed to store attachment", "err", err)
+			return status.Error(codes.Internal, "failed to store attachment")
+		}
+	}
+	if info.Size > 0 && w.size != info.Size {
+		return status.Errorf(codes.InvalidArgument, "expected %d bytes, got %d", info.Size, w.size)
+	}
+
+	attachment, err := w.commit(name)
+	if err != nil {
+		s.logger.Error("failed to store attachment", "err", err)
+		return status.Error(codes.Internal, "failed to store attachment")
+	}
+	// the same content may have been uploaded under another name before
+	attachment.Name = name
+	s.logger.Info("stored attachment", "id", attachment.Id, "name", name, "contentType", attachment.ContentType, "size", attachment.Size, "user", userFromContext(server.Context()))
+	return server.SendAndClose(&pb.UploadAttachmentResponse{Attachment: attachment})
+}
+
+func (s *ChatServerCmd) DownloadAttachment(request *pb.DownloadAttachmentRequest, server pb.ChatServer_DownloadAttachmentServer) error {
+	attachment, f, err := s.blobs.open(request.Id)
+	if errors.Is(err, errBlobNotFound) {
+		return status.Errorf(codes.NotFound, "attachment %q does not exist", request.Id)
+	}
+	if err != nil {
+		s.logger.Error("failed to read attachment", "id", request.Id, "err", err)
+		return status.Error(codes.Internal, "failed to read attachment")
+	}
+	defer f.Close()
+
+	if err := server.Send(&pb.DownloadAttachmentResponse{Part: &pb.DownloadAttachmentResponse_Info{Info: attachment}}); err != nil {
+		return err
+	}
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := server.Send(&pb.DownloadAttachmentResponse{Part: &pb.DownloadAttachmentResponse_Chunk{Chunk: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			s.logger.Error("failed to read attachment", "id", request.Id, "err", err)
+			return status.Error(codes.Internal, "failed to read attachment")
+		}
+	}
+}
+
+// resolveAttachments checks that the attachments of a message being sent exist and fills in what the store knows
+// about them. The names are the sender's, if it gave any.
+func (s *ChatServerCmd) resolveAttachments(cm *pb.ChatMessage) error {
+	if len(cm.Attachments) > maxAttachmentsPerMessage {
+		return status.Errorf(codes.InvalidArgument, "a message can't have more than %d attachments", maxAttachmentsPerMessage)
+	}
+	for i, ref := range cm.Attachments {
+		attachment, err := s.blobs.stat(ref.Id)
+		if errors.Is(err, errBlobNotFound) {
+			return status.Errorf(codes.NotFound, "attachment %q does not exist", ref.Id)
+		}
+		if err != nil {
+			s.logger.Error("failed to read attachment", "id", ref.Id, "err", err)
+			return status.Error(codes.Internal, "failed to read attachment")
+		}
+		if ref.Name != "" {
+			attachment.Name = sanitizeAttachmentName(ref.Name)
+		}
+		cm.Attachments[i] = attachment
+	}
+	return nil
+}
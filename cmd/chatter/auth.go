@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authorizationHeader = "authorization"
+	anonymousUser       = "anonymous"
+
+	// userFileCheckInterval limits how often the users file is checked for changes
+	userFileCheckInterval = time.Second
+
+	// maxVerifiedPasswords bounds the cache of passwords which passed bcrypt
+	maxVerifiedPasswords = 1024
+)
+
+// unauthenticatedMethods can be called without credentials.
+var unauthenticatedMethods = map[string]bool{
+	"/gen.ChatServer/Login": true,
+	// load balancers probe the server without credentials
+	"/grpc.health.v1.Health/Check": true,
+	"/grpc.health.v1.Health/Watch": true,
+}
+
+// clusterMethodPrefix is the prefix of the methods the servers of a cluster call on each other, they check the cluster
+// secret instead of user credentials.
+const clusterMethodPrefix = "/gen.Cluster/"
+
+func skipsAuthentication(method string) bool {
+	return unauthenticatedMethods[method] || strings.HasPrefix(method, clusterMethodPrefix)
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the name of the authenticated user of a call.
+func userFromContext(ctx context.Context) string {
+	if user, ok := ctx.Value(userContextKey{}).(string); ok {
+		return user
+	}
+	return anonymousUser
+}
+
+// userFile is a list of users and their bcrypt password hashes, one "name:hash" per line. The file is re-read when it
+// changes, so users can be added without restarting the server.
+type userFile struct {
+	path string
+
+	mu        sync.Mutex
+	modTime   time.Time
+	checkedAt time.Time
+	users     map[string][]byte
+}
+
+func loadUserFile(path string) (*userFile, error) {
+	f := &userFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *userFile) reload() error {
+	f.checkedAt = time.Now()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat users file: %w", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	users, err := readUsers(f.path)
+	if err != nil {
+		return err
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func readUsers(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users file: %w", err)
+	}
+	defer file.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" || hash == "" {
+			return nil, fmt.Errorf("invalid entry in users file on line %d", line)
+		}
+		users[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+	return users, nil
+}
+
+// hash returns the password hash of a user, reloading the file first if it changed. The file is checked at most once
+// every userFileCheckInterval.
+func (f *userFile) hash(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checkedAt) >= userFileCheckInterval {
+		_ = f.reload()
+	}
+	hash, ok := f.users[name]
+	return hash, ok
+}
+
+// authenticator verifies passwords against the users file and issues and verifies HMAC signed bearer tokens.
+type authenticator struct {
+	users     *userFile
+	secret    []byte
+	tokenTTL  time.Duration
+	dummyHash []byte
+
+	mu       sync.Mutex
+	verified map[string]bool // passwords which passed bcrypt, by verifiedKey
+}
+
+func newAuthenticator(usersFile, secretFile string, tokenTTL time.Duration) (*authenticator, error) {
+	users, err := loadUserFile(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := loadOrCreateSecret(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dummy hash: %w", err)
+	}
+	return &authenticator{users: users, secret: secret, tokenTTL: tokenTTL, dummyHash: dummyHash, verified: map[string]bool{}}, nil
+}
+
+// loadOrCreateSecret reads the token signing key, generating it on first use. Keeping it on disk means tokens stay
+// valid across restarts.
+func loadOrCreateSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err == nil {
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read auth secret: %w", err)
+	}
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate auth secret: %w", err)
+	}
+	if err := writeFileAtomic(path, secret); err != nil {
+		return nil, fmt.Errorf("failed to write auth secret: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to restrict auth secret permissions: %w", err)
+	}
+	return secret, nil
+}
+
+func (a *authenticator) checkPassword(username, password string) bool {
+	hash, ok := a.users.hash(username)
+	if !ok {
+		// compare anyway, so response times don't reveal which users exist
+		_ = bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+	// basic credentials come with every call, bcrypt runs once per password and hash
+	key := a.verifiedKey(username, password, hash)
+	a.mu.Lock()
+	ok = a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	if len(a.verified) >= maxVerifiedPasswords {
+		a.verified = map[string]bool{}
+	}
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+// verifiedKey identifies a password which passed bcrypt, without keeping the password itself around. It includes the
+// hash, so a changed password has to be verified again.
+func (a *authenticator) verifiedKey(username, password string, hash []byte) string {
+	mac := hmac.New(sha256.New, a.secret)
+	for _, part := range [][]byte{[]byte(username), []byte(password), hash} {
+		mac.Write([]byte(strconv.Itoa(len(part))))
+		mac.Write([]byte{0})
+		mac.Write(part)
+	}
+	return string(mac.Sum(nil))
+}
+
+// issueToken returns a token of the form base64(user).expiry.base64(hmac).
+func (a *authenticator) issueToken(username string) (string, time.Time) {
+	expiresAt := time.Now().Add(a.tokenTTL)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + a.sign(payload), expiresAt
+}
+
+func (a *authenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *authenticator) verifyToken(token string) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", errors.New("malformed token")
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return "", errors.New("invalid token signature")
+	}
+	encodedUser, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", errors.New("malformed token")
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	if time.Now().Unix() > expiresAt {
+		return "", errors.New("token expired")
+	}
+	username, err := base64.RawURLEncoding.DecodeString(encodedUser)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	if _, ok := a.users.hash(string(username)); !ok {
+		return "", errors.New("user no longer exists")
+	}
+	return string(username), nil
+}
+
+// authenticate accepts either a bearer token issued by Login or basic username and password credentials.
+func (a *authenticator) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationHeader)
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	scheme, credentials, _ := strings.Cut(values[0], " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		username, err := a.verifyToken(credentials)
+		if err != nil {
+			return "", status.Errorf(codes.Unauthenticated, "invalid token: %s", err)
+		}
+		return username, nil
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", status.Error(codes.Unauthenticated, "malformed basic credentials")
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		if !a.checkPassword(username, password) {
+			return "", status.Error(codes.Unauthenticated, "invalid username or password")
+		}
+		return username, nil
+	default:
+		return "", status.Errorf(codes.Unauthenticated, "unsupported authorization scheme %q", scheme)
+	}
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if skipsAuthentication(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	username, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, userContextKey{}, username), req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if skipsAuthentication(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	username, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), userContextKey{}, username)})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// clientAuthOptions are the authentication cli options shared by all commands connecting to the server.
+type clientAuthOptions struct {
+	User     string `help:"user to log in as" env:"CHATTER_USER"`
+	Password string `help:"password of the user" env:"CHATTER_PASSWORD"`
+	Token    string `help:"bearer token to authenticate with instead of a user and password" env:"CHATTER_TOKEN"`
+}
+
+type skipAuthContextKey struct{}
+
+// tokenCredentials attaches a bearer token to every call. If it was given a user and password it logs in on the first
+// call and again whenever the token is about to expire.
+type tokenCredentials struct {
+	user, password string
+
+	mu        sync.Mutex
+	pbClient  pb.ChatServerClient
+	token     string
+	expiresAt time.Time
+}
+
+func newTokenCredentials(options clientAuthOptions) *tokenCredentials {
+	return &tokenCredentials{user: options.User, password: options.Password, token: options.Token}
+}
+
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if ctx.Value(skipAuthContextKey{}) != nil {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.user != "" && (c.token == "" || time.Until(c.expiresAt) < time.Minute) {
+		resp, err := c.pbClient.Login(context.WithValue(ctx, skipAuthContextKey{}, true), &pb.LoginRequest{Username: c.user, Password: c.password})
+		if err != nil {
+			return nil, fmt.Errorf("failed to log in: %w", err)
+		}
+		c.token = resp.Token
+		c.expiresAt = resp.ExpiresAt.AsTime()
+	}
+	if c.token == "" {
+		return nil, nil
+	}
+	return map[string]string{authorizationHeader: "Bearer " + c.token}, nil
+}
+
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestAuthenticator returns an authenticator for the users alice and bob, both with the password "pw".
+func newTestAuthenticator(t *testing.T, tokenTTL time.Duration) (*authenticator, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(dir, "users")
+	if err := os.WriteFile(usersFile, []byte(fmt.Sprintf("alice:%s\nbob:%s\n", hash, hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthenticator(usersFile, filepath.Join(dir, "auth-secret"), tokenTTL)
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	return a, usersFile
+}
+
+func TestVerifyToken(t *testing.T) {
+	a, _ := newTestAuthenticator(t, time.Hour)
+	token, expiresAt := a.issueToken("alice")
+	if time.Until(expiresAt) < 59*time.Minute {
+		t.Fatalf("token expires at %s, want in an hour", expiresAt)
+	}
+	user, err := a.verifyToken(token)
+	if err != nil || user != "alice" {
+		t.Fatalf("verifying a fresh token gave %q, %v", user, err)
+	}
+
+	parts := strings.Split(token, ".")
+	bob := base64.RawURLEncoding.EncodeToString([]byte("bob"))
+	later := fmt.Sprint(time.Now().Add(24 * time.Hour).Unix())
+	other, _ := newTestAuthenticator(t, time.Hour)
+	otherToken, _ := other.issueToken("alice")
+	for name, tampered := range map[string]string{
+		"other user":       bob + "." + parts[1] + "." + parts[2],
+		"extended expiry":  parts[0] + "." + later + "." + parts[2],
+		"bad signature":    parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])),
+		"no signature":     parts[0] + "." + parts[1],
+		"garbage":          "garbage",
+		"other secret":     otherToken,
+		"empty":            "",
+		"signed no expiry": bob + "." + a.sign(bob),
+	} {
+		if user, err := a.verifyToken(tampered); err == nil {
+			t.Errorf("%s: tampered token was accepted for %q", name, user)
+		}
+	}
+}
+
+func TestVerifyTokenExpired(t *testing.T) {
+	a, _ := newTestAuthenticator(t, -time.Minute)
+	token, _ := a.issueToken("alice")
+	if _, err := a.verifyToken(token); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expired token gave %v", err)
+	}
+}
+
+func TestVerifyTokenDeletedUser(t *testing.T) {
+	a, usersFile := newTestAuthenticator(t, time.Hour)
+	token, _ := a.issueToken("bob")
+	hash, _ := a.users.hash("alice")
+	// the users file is reloaded when its modification time changes
+	if err := os.WriteFile(usersFile, []byte(fmt.Sprintf("alice:%s\n", hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(usersFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	// which is checked once the check interval passed
+	a.users.checkedAt = time.Now().Add(-userFileCheckInterval)
+	if _, err := a.verifyToken(token); err == nil {
+		t.Fatal("token of a deleted user was accepted")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, _ := newTestAuthenticator(t, time.Hour)
+	token, _ := a.issueToken("bob")
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	for _, tc := range []struct {
+		authorization string
+		user          string
+	}{
+		{authorization: "Bearer " + token, user: "bob"},
+		{authorization: "bearer " + token, user: "bob"},
+		{authorization: basic("alice", "pw"), user: "alice"},
+		{authorization: basic("alice", "wrong")},
+		{authorization: basic("carol", "pw")},
+		{authorization: "Bearer " + token + "x"},
+		{authorization: "Digest alice"},
+		{authorization: ""},
+	} {
+		ctx := context.Background()
+		if tc.authorization != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(authorizationHeader, tc.authorization))
+		}
+		user, err := a.authenticate(ctx)
+		if tc.user == "" {
+			if status.Code(err) != codes.Unauthenticated {
+				t.Errorf("%q: got %q, %v, want Unauthenticated", tc.authorization, user, err)
+			}
+			continue
+		}
+		if err != nil || user != tc.user {
+			t.Errorf("%q: got %q, %v, want %q", tc.authorization, user, err, tc.user)
+		}
+	}
+}
+
+func TestCheckPasswordCachesVerifiedPasswords(t *testing.T) {
+	a, usersFile := newTestAuthenticator(t, time.Hour)
+	if !a.checkPassword("alice", "pw") {
+		t.Fatal("right password was rejected")
+	}
+	if len(a.verified) != 1 {
+		t.Fatalf("%d verified passwords are cached, want 1", len(a.verified))
+	}
+	if a.checkPassword("alice", "wrong") || a.checkPassword("bob", "wrong") {
+		t.Fatal("wrong password was accepted")
+	}
+	if len(a.verified) != 1 {
+		t.Fatalf("%d verified passwords are cached, want only the right one", len(a.verified))
+	}
+
+	// a changed password doesn't match the cached one
+	hash, err := bcrypt.GenerateFromPassword([]byte("new"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(usersFile, []byte(fmt.Sprintf("alice:%s\n", hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(usersFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	a.users.checkedAt = time.Time{}
+	if a.checkPassword("alice", "pw") {
+		t.Fatal("old password was accepted after it changed")
+	}
+	if !a.checkPassword("alice", "new") {
+		t.Fatal("new password was rejected")
+	}
+}
+
+func TestDialRequiresTLSForCredentials(t *testing.T) {
+	for _, options := range []clientAuthOptions{{User: "alice", Password: "pw"}, {Token: "token"}} {
+		if conn, err := dial("localhost:8080", clientTLSOptions{}, options); err == nil {
+			conn.Close()
+			t.Errorf("%+v: dialed without TLS", options)
+		}
+	}
+	conn, err := dial("localhost:8080", clientTLSOptions{}, clientAuthOptions{})
+	if err != nil {
+		t.Fatalf("dialing without credentials failed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	pb "github.com/mwasilew2/chatter/gen"
+)
+
+// blobIdRegexp matches the ids of blobs, hex encoded SHA-256 hashes of their content.
+var blobIdRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// errBlobTooLarge is returned when a blob grows beyond the size limit of the store.
+var errBlobTooLarge = errors.New("blob too large")
+
+// errBlobNotFound is returned for ids which aren't in the store.
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStore keeps attachments on local disk, addressed by the SHA-256 of their content, so the same file uploaded twice
+// is stored once. Every blob is a file in a directory named after the first two characters of its id, next to a small
+// JSON file with its metadata.
+type blobStore struct {
+	dir     string
+	maxSize int64
+}
+
+// blobMeta is what's known about a blob besides its content.
+type blobMeta struct {
+	Name        string `json:"name"` // as given by the first upload
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+func openBlobStore(dir string, maxSize int64) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+	// uploads interrupted by a crash leave their temporary files behind
+	leftovers, err := filepath.Glob(filepath.Join(dir, "upload-*.tmp"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs directory: %w", err)
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	return &blobStore{dir: dir, maxSize: maxSize}, nil
+}
+
+func (b *blobStore) path(id string) string {
+	return filepath.Join(b.dir, id[:2], id)
+}
+
+// create starts writing a new blob, its id is only known once all of it was written.
+func (b *blobStore) create() (*blobWriter, error) {
+	f, err := os.CreateTemp(b.dir, "upload-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return &blobWriter{store: b, f: f, hash: sha256.New()}, nil
+}
+
+// stat returns the metadata of a blob.
+func (b *blobStore) stat(id string) (*pb.Attachment, error) {
+	if !blobIdRegexp.MatchString(id) {
+		return nil, errBlobNotFound
+	}
+	data, err := os.ReadFile(b.path(id) + ".json")
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of blob %s: %w", id, err)
+	}
+	var meta blobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of blob %s: %w", id, err)
+	}
+	return &pb.Attachment{Id: id, Name: meta.Name, ContentType: meta.ContentType, Size: meta.Size}, nil
+}
+
+// open returns the metadata and the content of a blob.
+func (b *blobStore) open(id string) (*pb.Attachment, *os.File, error) {
+	attachment, err := b.stat(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(b.path(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open blob %s: %w", id, err)
+	}
+	return attachment, f, nil
+}
+
+// blobWriter writes a blob to a temporary file, hashing it on the way.
+type blobWriter struct {
+	store *blobStore
+	f     *os.File
+	hash  hash.Hash
+	size  int64
+	head  []byte // the beginning of the content, for detecting its type
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.store.maxSize {
+		return 0, errBlobTooLarge
+	}
+	if len(w.head) < 512 {
+		n := 512 - len(w.head)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// commit moves the blob to its place in the store, unless the same content is there already.
+func (w *blobWriter) commit(name string) (*pb.Attachment, error) {
+	defer w.abort()
+	if err := w.f.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync blob: %w", err)
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close blob: %w", err)
+	}
+	id := hex.EncodeToString(w.hash.Sum(nil))
+	if attachment, err := w.store.stat(id); err == nil {
+		return attachment, nil
+	}
+
+	path := w.store.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(w.f.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to store blob: %w", err)
+	}
+	// the metadata is written last, a blob without it doesn't exist yet
+	meta := blobMeta{Name: name, ContentType: http.DetectContentType(w.head), Size: w.size}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata of blob %s: %w", id, err)
+	}
+	if err := writeFileAtomic(path+".json", data); err != nil {
+		return nil, fmt.Errorf("failed to write metadata of blob %s: %w", id, err)
+	}
+	return &pb.Attachment{Id: id, Name: meta.Name, ContentType: meta.ContentType, Size: meta.Size}, nil
+}
+
+// abort removes the temporary file, it's a no-op once the blob was committed.
+func (w *blobWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
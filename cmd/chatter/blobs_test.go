@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storeBlob writes content to the store in chunks of chunkSize and commits it under name.
+func storeBlob(t *testing.T, b *blobStore, name string, content []byte, chunkSize int) *pb.Attachment {
+	t.Helper()
+	w, err := b.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(content) > 0 {
+		n := chunkSize
+		if n > len(content) {
+			n = len(content)
+		}
+		if _, err := w.Write(content[:n]); err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	attachment, err := w.commit(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+// leftoverUploads returns the temporary files of uploads in a store.
+func leftoverUploads(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "upload-*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openBlobStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("%PDF-1.4 not really a pdf")
+	first := storeBlob(t, b, "report.pdf", content, 4)
+	if !blobIdRegexp.MatchString(first.Id) || first.Size != int64(len(content)) || first.Name != "report.pdf" || first.ContentType != "application/pdf" {
+		t.Fatalf("stored blob is %v", first)
+	}
+
+	attachment, f, err := b.open(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(data, content) || attachment.Name != "report.pdf" {
+		t.Fatalf("read back %v with %q, %v", attachment, data, err)
+	}
+
+	// the same content is stored once, under the name it was first uploaded with
+	second := storeBlob(t, b, "copy.pdf", content, 1024)
+	if second.Id != first.Id || second.Name != "report.pdf" {
+		t.Fatalf("second upload of the same content is %v, want %v", second, first)
+	}
+	blobs, err := filepath.Glob(filepath.Join(dir, first.Id[:2], "*"))
+	if err != nil || len(blobs) != 2 {
+		t.Fatalf("store has files %v, want the blob and its metadata", blobs)
+	}
+	if files := leftoverUploads(t, dir); len(files) != 0 {
+		t.Fatalf("temporary files are left behind: %v", files)
+	}
+
+	for _, id := range []string{"", "../../etc/passwd", first.Id[:63], first.Id[:63] + "0", "X" + first.Id[1:]} {
+		if _, err := b.stat(id); !errors.Is(err, errBlobNotFound) {
+			t.Errorf("%q: got %v, want errBlobNotFound", id, err)
+		}
+	}
+}
+
+func TestBlobStoreLimitsSize(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openBlobStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := b.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("writing up to the limit failed: %v", err)
+	}
+	if _, err := w.Write([]byte("a")); !errors.Is(err, errBlobTooLarge) {
+		t.Fatalf("writing beyond the limit gave %v, want errBlobTooLarge", err)
+	}
+	w.abort()
+	if files := leftoverUploads(t, dir); len(files) != 0 {
+		t.Fatalf("aborted upload left %v behind", files)
+	}
+}
+
+func TestBlobStoreRemovesInterruptedUploads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "upload-123.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBlobStore(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if files := leftoverUploads(t, dir); len(files) != 0 {
+		t.Fatalf("interrupted upload %v wasn't removed", files)
+	}
+}
+
+func TestSanitizeAttachmentName(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":             "report.pdf",
+		"docs/report.pdf":        "report.pdf",
+		"/etc/passwd":            "passwd",
+		"../../../etc/passwd":    "passwd",
+		"..":                     "",
+		"/":                      "",
+		"":                       "",
+		"dir/":                   "dir",
+		"./a/../b/./report.txt":  "report.txt",
+		"C:\\temp\\report.txt":   "C:\\temp\\report.txt",
+		"with spaces and ü.jpeg": "with spaces and ü.jpeg",
+	} {
+		if got := sanitizeAttachmentName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// upload sends content in the given chunks with info announcing size.
+func upload(ctx context.Context, client pb.ChatServerClient, name string, size int64, chunks ...[]byte) (*pb.Attachment, error) {
+	stream, err := client.UploadAttachment(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&pb.UploadAttachmentRequest{Part: &pb.UploadAttachmentRequest_Info{Info: &pb.UploadInfo{Name: name, Size: size}}}); err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(&pb.UploadAttachmentRequest{Part: &pb.UploadAttachmentRequest_Chunk{Chunk: chunk}}); err != nil {
+			// the server ended the upload, CloseAndRecv returns why
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Attachment, nil
+}
+
+func TestUploadAndDownloadAttachments(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.MaxAttachmentSize = 100 * 1024
+	var err error
+	if s.blobs, err = openBlobStore(t.TempDir(), s.MaxAttachmentSize); err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 5*1024) // 80 KiB
+	attachment, err := upload(ctx, ts.client, "../secret/notes.txt", int64(len(content)), content[:50000], content[50000:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Name != "notes.txt" || attachment.Size != int64(len(content)) {
+		t.Fatalf("uploaded attachment is %v", attachment)
+	}
+
+	// downloads come in chunks of at most attachmentChunkSize
+	stream, err := ts.client.DownloadAttachment(ctx, &pb.DownloadAttachmentRequest{Id: attachment.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := first.GetInfo(); info == nil || info.Id != attachment.Id || info.Size != attachment.Size {
+		t.Fatalf("download started with %v, want the info of the attachment", first)
+	}
+	var downloaded []byte
+	chunks := 0
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := resp.GetChunk()
+		if len(chunk) == 0 || len(chunk) > attachmentChunkSize {
+			t.Fatalf("chunk %d has %d bytes", chunks, len(chunk))
+		}
+		downloaded = append(downloaded, chunk...)
+		chunks++
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Fatalf("downloaded %d bytes which differ from the %d uploaded", len(downloaded), len(content))
+	}
+	if want := (len(content) + attachmentChunkSize - 1) / attachmentChunkSize; chunks != want {
+		t.Fatalf("download came in %d chunks, want %d", chunks, want)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		size   int64
+		chunks [][]byte
+	}{
+		{name: "announced too large", size: s.MaxAttachmentSize + 1, chunks: [][]byte{[]byte("x")}},
+		{name: "growing too large", chunks: [][]byte{make([]byte, s.MaxAttachmentSize), []byte("x")}},
+		{name: "shorter than announced", size: 10, chunks: [][]byte{[]byte("12345")}},
+		{name: "longer than announced", size: 3, chunks: [][]byte{[]byte("12345")}},
+	} {
+		if _, err := upload(ctx, ts.client, "file", tc.size, tc.chunks...); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", tc.name, err)
+		}
+	}
+	if files := leftoverUploads(t, s.blobs.dir); len(files) != 0 {
+		t.Fatalf("refused uploads left %v behind", files)
+	}
+
+	missing, err := ts.client.DownloadAttachment(ctx, &pb.DownloadAttachmentRequest{Id: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := missing.Recv(); status.Code(err) != codes.NotFound {
+		t.Fatalf("downloading a missing attachment gave %v, want NotFound", err)
+	}
+}
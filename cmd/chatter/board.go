@@ -4,25 +4,33 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"time"
 
 	"golang.org/x/exp/slog"
 
 	pb "github.com/mwasilew2/chatter/gen"
 	"github.com/oklog/run"
 	"github.com/oklog/ulid"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type ChatBoardCmd struct {
 	// cli options
-	Addr string `help:"address to connect on" default:":8080"`
+	Addr     string `help:"address to connect on" default:":8080"`
+	Room     string `help:"room to print messages from" default:"general"`
+	StateDir string `help:"directory to remember the id of the last printed message of every room in, the board resumes from it on start" default:"${state_dir}" type:"path"`
+	Threads  string `help:"how to show replies: flat like any other message, indent to print them indented and marked as replies, or collapse to only note that a thread got a reply" enum:"flat,indent,collapse" default:"flat"`
+
+	clientTLSOptions  `embed:""`
+	clientAuthOptions `embed:""`
+	reconnectOptions  `embed:""`
 
 	// State
-	id ulid.ULID
+	id         ulid.ULID
+	lastId     int32
+	lastIdFile string
 
 	// Dependencies
 	logger *slog.Logger
@@ -30,10 +38,13 @@ type ChatBoardCmd struct {
 
 func (b *ChatBoardCmd) Run(cmdCtx *cmdContext) error {
 	b.logger = cmdCtx.Logger.With("component", "ChatBoardCmd")
-	b.logger.Info("starting chat board", "addr", b.Addr)
+	if err := b.reconnectOptions.validate(); err != nil {
+		return err
+	}
+	b.logger.Info("starting chat board", "addr", b.Addr, "room", b.Room)
 
 	// set up grpc client
-	conn, err := grpc.Dial(b.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := dial(b.Addr, b.clientTLSOptions, b.clientAuthOptions, b.reconnectOptions.dialOptions()...)
 	if err != nil {
 		return fmt.Errorf("failed to dial server: %w", err)
 	}
@@ -48,6 +59,20 @@ func (b *ChatBoardCmd) Run(cmdCtx *cmdContext) error {
 	b.id = u
 	b.logger.Debug("generated ulid", "ulid", b.id.String())
 
+	// resume from the last printed message
+	b.lastIdFile = filepath.Join(b.StateDir, "board", b.Room+".last-id")
+	if b.Room == defaultRoom {
+		// before rooms, the board only printed the default room and kept its last id at the top of the state directory
+		if err := migrateLastId(filepath.Join(b.StateDir, "board-last-id"), b.lastIdFile); err != nil {
+			return fmt.Errorf("failed to migrate last id: %w", err)
+		}
+	}
+	b.lastId, err = readLastId(b.lastIdFile)
+	if err != nil {
+		return fmt.Errorf("failed to read last id: %w", err)
+	}
+	b.logger.Debug("resuming from last id", "lastId", b.lastId)
+
 	// run goroutines
 	g := run.Group{}
 
@@ -68,46 +93,104 @@ func (b *ChatBoardCmd) Run(cmdCtx *cmdContext) error {
 		close(done)
 	})
 
-	// print incoming messages
-	donePrinter := make(chan struct{})
+	// print incoming messages, reconnecting whenever the connection breaks
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	g.Add(func() error {
-		stream, err := pbClient.Receive(ctx, &pb.ReceiveRequest{
+		request := &pb.ReceiveRequest{
 			ClientId: b.id.String(),
-			LastId:   0,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to connect to stream: %w", err)
+			LastId:   b.lastId,
+			Room:     b.Room,
 		}
-		for {
-			select {
-			case <-stream.Context().Done():
-				if err := stream.Context().Err(); err != nil {
-					return fmt.Errorf("stream context error: %w", err)
-				}
+		err := subscribe(ctx, pbClient, request, b.reconnectOptions, func(r *pb.ReceiveResponse) error {
+			cm := r.ChatMessage
+			if system := cm.GetSystem(); system != nil {
+				b.logger.Info("server event", "kind", system.Kind.String(), "time", cm.Timestamp.AsTime(), "text", system.Text)
+				return nil
+			}
+			if t := cm.GetTyping(); t != nil {
+				b.logger.Info(describe(cm), "user", t.User, "displayName", t.DisplayName)
 				return nil
-			case <-donePrinter:
-				b.logger.Debug("closed printer goroutine")
+			}
+			if m := cm.GetMembership(); m != nil {
+				b.logger.Info("membership changed", "kind", m.Kind.String(), "user", m.User, "displayName", m.DisplayName, "time", cm.Timestamp.AsTime())
 				return nil
+			}
+			if cm.Recipient != "" {
+				// direct messages aren't part of the room, so they don't move the position in it
+				b.logger.Info("direct message received", "id", cm.Id, "conversation", cm.Room, "author", cm.Author, "recipient", cm.Recipient, "time", cm.Timestamp.AsTime(), "message", describe(cm))
+				return nil
+			}
+			// edits and deletions refer to a line printed before, messages replayed after them come as they are now
+			switch {
+			case cm.GetEdit() != nil:
+				b.logger.Info("message edited", "id", cm.GetEdit().MessageId, "editor", cm.Author, "time", cm.Timestamp.AsTime(), "message", cm.GetEdit().Text)
+			case cm.GetDelete() != nil:
+				b.logger.Info("message deleted", "id", cm.GetDelete().MessageId, "by", cm.Author, "time", cm.Timestamp.AsTime())
+			case cm.GetReaction() != nil:
+				r := cm.GetReaction()
+				b.logger.Info("reaction changed", "id", r.MessageId, "user", cm.Author, "emoji", r.Emoji, "removed", r.Removed, "time", cm.Timestamp.AsTime())
 			default:
-				r, err := stream.Recv() // this is a blocking call, can be canceled by closing the relevant context
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					return fmt.Errorf("failed to receive message: %w", err)
-				}
-				b.logger.Info("message received", "message", r.Message)
+				b.printMessage(cm)
 			}
+			b.lastId = r.Id
+			if err := writeLastId(b.lastIdFile, b.lastId); err != nil {
+				b.logger.Error("failed to persist last id", "err", err)
+			}
+			return nil
+		}, func(state streamState, err error, retryIn time.Duration) {
+			if state == streamConnected {
+				b.logger.Info("connected to server", "lastId", b.lastId)
+				return
+			}
+			b.logger.Warn("lost connection to server, reconnecting", "err", err, "retryIn", retryIn)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to receive messages: %w", err)
 		}
 		return nil
 	}, func(err error) {
 		b.logger.Debug("closing printer goroutine")
-		close(donePrinter)
 		cancel()
-		b.logger.Debug("closed printer goroutine")
 	})
 
 	return g.Run()
 }
+
+// printMessage prints a stored message, replies the way --threads asks for.
+func (b *ChatBoardCmd) printMessage(cm *pb.ChatMessage) {
+	if cm.ParentId != 0 && b.Threads == "collapse" {
+		b.logger.Info("thread got a reply", "id", cm.ParentId, "author", cm.Author, "time", cm.Timestamp.AsTime())
+		return
+	}
+
+	msg := "message received"
+	text := describe(cm)
+	args := []interface{}{"id", cm.Id, "author", cm.Author, "time", cm.Timestamp.AsTime()}
+	if cm.ParentId != 0 {
+		args = append(args, "parent", cm.ParentId)
+		if b.Threads == "indent" {
+			msg = "    ↳ reply received"
+			text = "    ↳ " + text
+		}
+	}
+	if cm.Deleted {
+		args = append(args, "deleted", true)
+	} else {
+		args = append(args, "message", text)
+	}
+	if cm.EditedAt != nil {
+		args = append(args, "editedAt", cm.EditedAt.AsTime())
+	}
+	if cm.ReplyCount > 0 {
+		args = append(args, "replies", cm.ReplyCount)
+	}
+	if len(cm.Attachments) > 0 {
+		ids := make([]string, 0, len(cm.Attachments))
+		for _, attachment := range cm.Attachments {
+			ids = append(ids, attachment.Id)
+		}
+		args = append(args, "attachments", ids)
+	}
+	b.logger.Info(msg, args...)
+}
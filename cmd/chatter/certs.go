@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type ChatCertsCmd struct {
+	// cli options
+	OutDir     string        `help:"directory to write the certificates and keys to" default:"certs" type:"path"`
+	Hosts      []string      `help:"host names and IP addresses the server certificate is valid for" default:"localhost,127.0.0.1,::1"`
+	ClientName string        `help:"common name of the client certificate" default:"chatter-client"`
+	ValidFor   time.Duration `help:"validity period of the certificates" default:"8760h"`
+	Force      bool          `help:"overwrite existing files"`
+
+	// Dependencies
+	logger *slog.Logger
+}
+
+// Run generates a self-signed CA and a server and a client certificate signed by it. They are meant for local testing
+// only.
+func (c *ChatCertsCmd) Run(cmdCtx *cmdContext) error {
+	c.logger = cmdCtx.Logger.With("component", "ChatCertsCmd")
+
+	// checked before anything is written, the server certificate is named after the first host
+	var hosts []string
+	for _, h := range c.Hosts {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return errors.New("--hosts needs at least one host name or IP address")
+	}
+	c.Hosts = hosts
+
+	if err := os.MkdirAll(c.OutDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if !c.Force {
+		for _, name := range []string{"ca.pem", "ca-key.pem", "server.pem", "server-key.pem", "client.pem", "client-key.pem"} {
+			if _, err := os.Stat(filepath.Join(c.OutDir, name)); err == nil {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", filepath.Join(c.OutDir, name))
+			}
+		}
+	}
+
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(c.ValidFor)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ca key: %w", err)
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "chatter local CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCert, err := c.writeCert("ca", caTemplate, caTemplate, caKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: c.Hosts[0]},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range c.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, h)
+		}
+	}
+	if err := c.writeLeaf("server", serverTemplate, caCert, caKey); err != nil {
+		return err
+	}
+
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: c.ClientName},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if err := c.writeLeaf("client", clientTemplate, caCert, caKey); err != nil {
+		return err
+	}
+
+	c.logger.Info("generated certificates", "dir", c.OutDir, "hosts", c.Hosts, "client", c.ClientName, "notAfter", notAfter)
+	return nil
+}
+
+func (c *ChatCertsCmd) writeLeaf(name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate %s key: %w", name, err)
+	}
+	_, err = c.writeCert(name, template, parent, key, parentKey)
+	return err
+}
+
+// writeCert signs template with parentKey and writes the certificate and its private key as name.pem and
+// name-key.pem.
+func (c *ChatCertsCmd) writeCert(name string, template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+	if template == parent {
+		parent.SerialNumber = serial
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s certificate: %w", name, err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s key: %w", name, err)
+	}
+
+	certPath := filepath.Join(c.OutDir, name+".pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", certPath, err)
+	}
+	keyPath := filepath.Join(c.OutDir, name+"-key.pem")
+	// WriteFile keeps the mode of an existing file, an overwritten key mustn't stay readable by others
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove %s: %w", keyPath, err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", keyPath, err)
+	}
+	c.logger.Debug("wrote certificate", "cert", certPath, "key", keyPath)
+
+	return x509.ParseCertificate(der)
+}
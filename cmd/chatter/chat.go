@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// flow is the flow control of a Chat stream. The client grants credits for a number of messages, the server stops
+// sending once they're used up and lets the subscriber's queue fill up instead. Work which has to run on the goroutine
+// sending to the stream, like acknowledgements, is passed in through control. A nil flow never blocks.
+type flow struct {
+	unlimited bool
+	credit    uint64
+	work      chan func() error
+}
+
+func newFlow(window uint32) *flow {
+	return &flow{unlimited: window == 0, credit: uint64(window), work: make(chan func() error)}
+}
+
+// open tells whether another message may be sent.
+func (f *flow) open() bool {
+	return f == nil || f.unlimited || f.credit > 0
+}
+
+// spend uses up the credit for a sent message.
+func (f *flow) spend() {
+	if f != nil && !f.unlimited && f.credit > 0 {
+		f.credit--
+	}
+}
+
+func (f *flow) grant(messages uint32) {
+	f.credit += uint64(messages)
+}
+
+// control returns the channel of work to run, nil if there's none.
+func (f *flow) control() <-chan func() error {
+	if f == nil {
+		return nil
+	}
+	return f.work
+}
+
+// wait runs work until another message may be sent.
+func (f *flow) wait(ctx context.Context) error {
+	for !f.open() {
+		select {
+		case work := <-f.work:
+			if err := work(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Chat carries both directions of a conversation on one stream. After the client opened it with a subscription, it
+// receives the messages of the room as from Receive, while the messages it sends are handled as by Send and
+// acknowledged one by one with the sequence number the client gave them. Both sides send heartbeats.
+func (s *ChatServerCmd) Chat(server pb.ChatServer_ChatServer) error {
+	ctx, cancel := context.WithCancel(server.Context())
+	defer cancel()
+
+	first, err := server.Recv()
+	if err != nil {
+		return err
+	}
+	open := first.GetOpen()
+	if open == nil || open.Receive == nil {
+		return status.Error(codes.InvalidArgument, "the first message of a chat has to open it")
+	}
+	f := newFlow(open.Window)
+	var lastHeard atomic.Int64
+	lastHeard.Store(time.Now().UnixNano())
+
+	// push hands work to the goroutine sending to the stream, unless the stream already ended
+	push := func(work func() error) bool {
+		select {
+		case f.work <- work:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		// the stream is over once the client stops sending, whether it closed its side or the connection broke
+		defer cancel()
+		for {
+			request, err := server.Recv()
+			if err != nil {
+				return
+			}
+			lastHeard.Store(time.Now().UnixNano())
+			switch kind := request.Kind.(type) {
+			case *pb.ChatRequest_Send:
+				ack := s.chatSend(ctx, kind.Send)
+				if !push(func() error { return server.Send(&pb.ChatResponse{Kind: &pb.ChatResponse_Ack{Ack: ack}}) }) {
+					return
+				}
+			case *pb.ChatRequest_Credit:
+				messages := kind.Credit.GetMessages()
+				if !push(func() error { f.grant(messages); return nil }) {
+					return
+				}
+			case *pb.ChatRequest_Heartbeat:
+			case *pb.ChatRequest_Open:
+				push(func() error { return status.Error(codes.InvalidArgument, "a chat can only be opened once") })
+				return
+			}
+		}
+	}()
+
+	// the client's heartbeats are checked whenever one of the server's is due
+	heartbeat := func(string) error {
+		if silence := time.Since(time.Unix(0, lastHeard.Load())); silence > missedHeartbeats*s.HeartbeatInterval {
+			s.logger.Warn("closing silent chat stream", "clientId", open.Receive.ClientId, "silence", silence)
+			return status.Error(codes.DeadlineExceeded, "no heartbeat from the client")
+		}
+		heartbeat := &pb.Heartbeat{Timestamp: timestamppb.Now(), Interval: durationpb.New(s.HeartbeatInterval)}
+		return server.Send(&pb.ChatResponse{Kind: &pb.ChatResponse_Heartbeat{Heartbeat: heartbeat}})
+	}
+
+	return s.deliver(ctx, open.Receive, server, func(msg *pb.ReceiveResponse) error {
+		return server.Send(&pb.ChatResponse{Kind: &pb.ChatResponse_Message{Message: msg}})
+	}, heartbeat, f)
+}
+
+// chatSend handles a message sent on a Chat stream and returns its acknowledgement.
+func (s *ChatServerCmd) chatSend(ctx context.Context, send *pb.ChatSend) *pb.ChatAck {
+	ack := &pb.ChatAck{Seq: send.Seq}
+	if send.Request == nil {
+		ack.Code, ack.Error = int32(codes.InvalidArgument), "missing request"
+		return ack
+	}
+	resp, err := s.Send(ctx, send.Request)
+	if err != nil {
+		st := status.Convert(err)
+		ack.Code, ack.Error = int32(st.Code()), st.Message()
+		return ack
+	}
+	ack.Response = resp
+	return ack
+}
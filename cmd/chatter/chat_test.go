@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFlowCredit(t *testing.T) {
+	f := newFlow(2)
+	for i := 0; i < 2; i++ {
+		if !f.open() {
+			t.Fatalf("flow closed after %d of 2 messages", i)
+		}
+		f.spend()
+	}
+	if f.open() {
+		t.Fatal("flow still open with its credit used up")
+	}
+	// spending without credit doesn't wrap around
+	f.spend()
+	f.grant(1)
+	if !f.open() {
+		t.Fatal("flow closed after granting credit")
+	}
+	f.spend()
+	if f.open() {
+		t.Fatal("flow open after using up granted credit")
+	}
+}
+
+func TestFlowUnlimited(t *testing.T) {
+	for name, f := range map[string]*flow{"no window": newFlow(0), "nil": nil} {
+		for i := 0; i < 1000; i++ {
+			f.spend()
+		}
+		if !f.open() {
+			t.Errorf("%s: flow closed", name)
+		}
+		if err := f.wait(context.Background()); err != nil {
+			t.Errorf("%s: wait failed: %v", name, err)
+		}
+	}
+	var f *flow
+	if f.control() != nil {
+		t.Error("nil flow has work to run")
+	}
+}
+
+func TestFlowWait(t *testing.T) {
+	f := newFlow(1)
+	f.spend()
+
+	// work handed in while waiting runs, and the wait ends once it granted credit
+	ran := make(chan struct{})
+	go func() {
+		f.work <- func() error { close(ran); return nil }
+		f.work <- func() error { f.grant(3); return nil }
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.wait(ctx); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Fatal("work didn't run while waiting")
+	}
+	for i := 0; i < 3; i++ {
+		if !f.open() {
+			t.Fatalf("flow closed after %d of 3 granted messages", i)
+		}
+		f.spend()
+	}
+
+	// failing work ends the wait with its error
+	failed := errors.New("send failed")
+	go func() { f.work <- func() error { return failed } }()
+	if err := f.wait(ctx); !errors.Is(err, failed) {
+		t.Fatalf("wait returned %v, want the error of the work", err)
+	}
+
+	// as does the end of the stream
+	canceled, cancelWait := context.WithCancel(context.Background())
+	cancelWait()
+	if err := f.wait(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait returned %v, want context.Canceled", err)
+	}
+}
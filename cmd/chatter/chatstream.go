@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// chatWindow is the number of messages the server may send on a Chat stream before the client grants more credit
+	chatWindow = 64
+
+	// chatHeartbeat is how often heartbeats are sent until the server told how often it sends its own
+	chatHeartbeat = 15 * time.Second
+)
+
+// chatHandlers are called by chat as the stream goes.
+type chatHandlers struct {
+	onMessage func(*pb.ReceiveResponse) error
+	onState   func(state streamState, err error, retryIn time.Duration)
+	onSent    func(outboxEntry, *pb.SendResponse)
+	onError   func(outboxEntry, error)
+}
+
+// chat runs a Chat stream until ctx is done. It receives the messages of a room like subscribe and sends the messages
+// queued in the outbox like its Flush, one at a time, removing each once the server acknowledged it. Whenever the
+// stream breaks, or the server stops sending heartbeats, it reconnects after a backoff delay, asking for everything
+// after the last received message and resending the message which wasn't acknowledged. Only errors which retrying won't
+// fix are returned, Unimplemented among them if the server predates the Chat RPC.
+func chat(ctx context.Context, pbClient pb.ChatServerClient, request *pb.ReceiveRequest, ob *outbox, options reconnectOptions, handlers chatHandlers) error {
+	b := options.backoff()
+	request = proto.Clone(request).(*pb.ReceiveRequest)
+	for {
+		err := chatOnce(ctx, pbClient, request, ob, handlers, func() {
+			b.Reset()
+			handlers.onState(streamConnected, nil, 0)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		delay := b.Next()
+		handlers.onState(streamDisconnected, err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil
+		}
+	}
+}
+
+// chatOnce runs a single Chat stream until it breaks. Messages are received on the calling goroutine, everything the
+// client sends goes through a second one, since a stream can't be sent to concurrently.
+func chatOnce(ctx context.Context, pbClient pb.ChatServerClient, request *pb.ReceiveRequest, ob *outbox, handlers chatHandlers, onConnected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pbClient.Chat(ctx)
+	if err != nil {
+		return err
+	}
+	open := &pb.ChatOpen{Receive: request, Window: chatWindow}
+	if err := stream.Send(&pb.ChatRequest{Kind: &pb.ChatRequest_Open{Open: open}}); err != nil {
+		return err
+	}
+	// the stream is only known to work once the server answered, headers are sent as soon as it subscribed the client
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+	onConnected()
+
+	acks := make(chan *pb.ChatAck)
+	credits := make(chan uint32)
+	intervals := make(chan time.Duration)
+	var lastHeard atomic.Int64
+	lastHeard.Store(time.Now().UnixNano())
+
+	senderErr := make(chan error, 1)
+	go func() {
+		err := chatSender(ctx, stream, ob, handlers, acks, credits, intervals, &lastHeard)
+		senderErr <- err
+		// the receiving side has to stop as well
+		cancel()
+	}()
+
+	var received uint32
+	var interval time.Duration
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			cancel()
+			// a stream the sending side gave up on breaks for its reason
+			if sendErr := <-senderErr; sendErr != nil {
+				return sendErr
+			}
+			return err
+		}
+		lastHeard.Store(time.Now().UnixNano())
+		switch kind := resp.Kind.(type) {
+		case *pb.ChatResponse_Message:
+			msg := kind.Message
+			// servers predating the envelope only fill the flat fields
+			normalize(msg)
+			if msg.Id > 0 && inRoom(msg, request.Room) {
+				// system events have no id, direct messages have ids of their conversation
+				request.LastId = msg.Id
+			}
+			if err := handlers.onMessage(msg); err != nil {
+				return err
+			}
+			// give the credit back in batches rather than for every message
+			if received++; received >= chatWindow/2 {
+				select {
+				case credits <- received:
+					received = 0
+				case <-ctx.Done():
+				}
+			}
+		case *pb.ChatResponse_Ack:
+			select {
+			case acks <- kind.Ack:
+			case <-ctx.Done():
+			}
+		case *pb.ChatResponse_Heartbeat:
+			if d := kind.Heartbeat.GetInterval().AsDuration(); d > 0 && d != interval {
+				select {
+				case intervals <- d:
+					interval = d
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+}
+
+// chatSender sends the messages queued in the outbox, the credits granted by the receiving side and heartbeats on a
+// Chat stream. Once the server told how often it sends heartbeats, it also gives up on the stream when the server stays
+// silent for too long.
+func chatSender(ctx context.Context, stream pb.ChatServer_ChatClient, ob *outbox, handlers chatHandlers, acks <-chan *pb.ChatAck, credits <-chan uint32, intervals <-chan time.Duration, lastHeard *atomic.Int64) error {
+	// the interval of the server's heartbeats, unknown until the first one arrives
+	var interval time.Duration
+	ticker := time.NewTicker(chatHeartbeat)
+	defer ticker.Stop()
+
+	var seq uint64
+	var inflight *outboxEntry
+	for {
+		if inflight == nil {
+			if entry, ok := ob.peek(); ok {
+				seq++
+				send := &pb.ChatSend{Seq: seq, Request: entry.request()}
+				if err := stream.Send(&pb.ChatRequest{Kind: &pb.ChatRequest_Send{Send: send}}); err != nil {
+					return err
+				}
+				inflight = &entry
+			}
+		}
+
+		select {
+		case <-ob.added:
+		case ack := <-acks:
+			if inflight == nil || ack.Seq != seq {
+				continue
+			}
+			entry := *inflight
+			inflight = nil
+			if code := codes.Code(ack.Code); code != codes.OK {
+				err := status.Error(code, ack.Error)
+				if isRetryable(err) {
+					// the message stays queued and is sent again once reconnected
+					return err
+				}
+				handlers.onError(entry, err)
+			} else {
+				handlers.onSent(entry, ack.Response)
+			}
+			if err := ob.remove(entry.IdempotencyKey); err != nil {
+				handlers.onError(entry, err)
+			}
+		case n := <-credits:
+			credit := &pb.ChatCredit{Messages: n}
+			if err := stream.Send(&pb.ChatRequest{Kind: &pb.ChatRequest_Credit{Credit: credit}}); err != nil {
+				return err
+			}
+		case d := <-intervals:
+			// keep up with the server, it closes streams which stay silent for too long
+			interval = d
+			ticker.Reset(interval)
+		case <-ticker.C:
+			if silence := time.Since(time.Unix(0, lastHeard.Load())); interval > 0 && silence > missedHeartbeats*interval {
+				return status.Errorf(codes.Unavailable, "no heartbeat from the server for %s", silence.Round(time.Second))
+			}
+			heartbeat := &pb.Heartbeat{Timestamp: timestamppb.Now()}
+			if interval > 0 {
+				heartbeat.Interval = durationpb.New(interval)
+			}
+			if err := stream.Send(&pb.ChatRequest{Kind: &pb.ChatRequest_Heartbeat{Heartbeat: heartbeat}}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
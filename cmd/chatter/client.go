@@ -3,9 +3,14 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/exp/slog"
@@ -13,13 +18,28 @@ import (
 	"github.com/muesli/cancelreader"
 	pb "github.com/mwasilew2/chatter/gen"
 	"github.com/oklog/run"
+	"github.com/oklog/ulid"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
 type ChatClientCmd struct {
 	// cli options
-	Addr string `help:"address to connect to" default:":8080"`
+	Addr    string `help:"address to connect to" default:":8080"`
+	Room    string `help:"room to send messages to" default:"general"`
+	TUI     bool   `name:"tui" help:"start a full-screen chat window which also shows incoming messages"`
+	History int32  `help:"number of past messages shown when the chat window opens" default:"50"`
+	LogFile string `help:"file to write logs to while the chat window is open, logs are discarded if empty" type:"path"`
+	Outbox  string `help:"file to keep messages in until the server received them, it shouldn't be shared by clients running at the same time" default:"${state_dir}/outbox.json" type:"path"`
+
+	DisplayName string `help:"name shown to the other members of the room in the chat window, defaults to the user name"`
+	DownloadDir string `help:"directory /download saves attachments in" default:"." type:"path"`
+
+	clientTLSOptions  `embed:""`
+	clientAuthOptions `embed:""`
+	reconnectOptions  `embed:""`
 
 	// Dependencies
 	logger *slog.Logger
@@ -27,22 +47,50 @@ type ChatClientCmd struct {
 
 func (c *ChatClientCmd) Run(cmdCtx *cmdContext) error {
 	c.logger = cmdCtx.Logger.With("component", "ChatClientCmd")
-	c.logger.Info("starting chat client", "addr", c.Addr)
+	if err := c.reconnectOptions.validate(); err != nil {
+		return err
+	}
+	if c.TUI {
+		// logging to stderr would garble the screen
+		var w io.Writer = io.Discard
+		if c.LogFile != "" {
+			f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to open log file: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		c.logger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: programLevel})).With("component", "ChatClientCmd")
+	}
+	c.logger.Info("starting chat client", "addr", c.Addr, "room", c.Room)
 
 	// set up grpc client
-	conn, err := grpc.Dial(c.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := dial(c.Addr, c.clientTLSOptions, c.clientAuthOptions, c.reconnectOptions.dialOptions()...)
 	if err != nil {
 		return fmt.Errorf("failed to dial server: %w", err)
 	}
 	defer conn.Close()
 	pbClient := pb.NewChatServerClient(conn)
 
+	// messages left over from a previous run are sent first
+	ob, err := openOutbox(c.Outbox)
+	if err != nil {
+		return err
+	}
+	if n := ob.Len(); n > 0 {
+		c.logger.Info("sending messages left in the outbox", "count", n)
+	}
+
+	if c.TUI {
+		return c.runTUI(conn, pbClient, ob)
+	}
+
 	// run goroutines
 	g := run.Group{}
-	errChan := make(chan error)
 
 	// listen for termination signals
-	osSigChan := make(chan os.Signal)
+	osSigChan := make(chan os.Signal, 1)
 	signal.Notify(osSigChan, os.Kill, os.Interrupt)
 	done := make(chan struct{})
 	g.Add(func() error {
@@ -58,49 +106,492 @@ func (c *ChatClientCmd) Run(cmdCtx *cmdContext) error {
 		close(done)
 	})
 
-	// print errors as they come in
+	// report changes of the connection state
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	g.Add(func() error {
-		for e := range errChan {
-			c.logger.Error("error", "err", e)
-		}
+		var previous connectivity.State
+		watchConnection(ctx, conn, func(state connectivity.State) {
+			switch {
+			case state == connectivity.TransientFailure:
+				c.logger.Warn("lost connection to server, reconnecting")
+			case state == connectivity.Ready && previous == connectivity.TransientFailure:
+				c.logger.Info("reconnected to server")
+			}
+			c.logger.Debug("connection state changed", "state", state.String())
+			previous = state
+		})
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	// send queued messages to the grpc server
+	g.Add(func() error {
+		ob.Flush(ctx, pbClient, c.reconnectOptions, func(entry outboxEntry, resp *pb.SendResponse) {
+			c.logger.Info("message sent", "id", resp.Id, "duplicate", resp.Duplicate, "room", entry.Room, "recipient", entry.Recipient)
+		}, func(err error, retryIn time.Duration) {
+			c.logger.Warn("failed to send message, retrying", "err", err, "retryIn", retryIn, "queued", ob.Len())
+		}, func(entry outboxEntry, err error) {
+			c.logger.Error("failed to send message, dropping it", "err", err, "room", entry.Room, "recipient", entry.Recipient, "message", entry.Message)
+		})
 		return nil
 	}, func(err error) {
-		c.logger.Debug("closing error printing goroutine")
-		close(errChan)
+		cancel()
 	})
 
-	// read input from the user and send messages to the grpc server
+	// read input from the user and queue it in the outbox
 	{
-		var cReader cancelreader.CancelReader // bufio.Scanner.Scan() is a blocking call, and it's impossible to close os.Stdin, so linux epoll has to be used, a library for that is used here instead of implementing it myself
-		var err error
+		// bufio.Scanner.Scan() is a blocking call, and it's impossible to close os.Stdin, so linux epoll has to be used, a library for that is used here instead of implementing it myself
+		cReader, err := cancelreader.NewReader(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to create cancel reader: %w", err)
+		}
 		g.Add(func() error {
-			cReader, err = cancelreader.NewReader(os.Stdin)
-			if err != nil {
-				return fmt.Errorf("failed to create cancel reader: %w", err)
-			}
 			scanner := bufio.NewScanner(cReader)
 			c.logger.Info("enter message to send")
 			for scanner.Scan() {
-				line := scanner.Text()
-				ctext, cancel := context.WithTimeout(context.Background(), time.Second)
-				defer cancel()
-				resp, err := pbClient.Send(ctext, &pb.SendRequest{Message: line})
+				if scanner.Text() == "/who" {
+					lines, err := c.who(ctx, pbClient)
+					if err != nil {
+						c.logger.Error("failed to list members", "err", err)
+						continue
+					}
+					for _, line := range lines {
+						fmt.Println(line)
+					}
+					continue
+				}
+				if command, arg, ok := transferCommand(scanner.Text()); ok {
+					var result string
+					var err error
+					if command == "/upload" {
+						result, err = c.upload(ctx, pbClient, ob, arg)
+					} else {
+						result, err = c.download(ctx, pbClient, arg)
+					}
+					if err != nil {
+						c.logger.Error("failed to transfer attachment", "err", err)
+						continue
+					}
+					fmt.Println(result)
+					continue
+				}
+				if request, ok, err := c.parseReaction(scanner.Text()); ok {
+					if err == nil {
+						var resp *pb.ReactResponse
+						if resp, err = c.react(ctx, pbClient, request); err == nil {
+							fmt.Printf("reactions to message %d: %s\n", request.MessageId, formatReactions(resp.Reactions))
+						}
+					}
+					if err != nil {
+						c.logger.Error("failed to react", "err", err)
+					}
+					continue
+				}
+				entry, err := c.target(scanner.Text())
 				if err != nil {
-					errChan <- fmt.Errorf("failed to send message: %w", err)
-					cancel()
+					c.logger.Error("invalid command", "err", err)
 					continue
 				}
-				c.logger.Info("message sent", "response", resp)
+				entry, err = ob.Add(entry)
+				if err != nil {
+					c.logger.Error("failed to queue message", "err", err)
+					continue
+				}
+				c.logger.Debug("message queued", "idempotencyKey", entry.IdempotencyKey)
 			}
 			if err := scanner.Err(); err != nil {
 				return fmt.Errorf("failed to read input: %w", err)
 			}
+			// the input ended, wait for everything typed to be sent before exiting
+			for ob.Len() > 0 {
+				if err := sleep(ctx, 100*time.Millisecond); err != nil {
+					return nil
+				}
+			}
 			return nil
 		}, func(err error) {
 			c.logger.Debug("closing input reading goroutine")
 			cReader.Cancel()
+			cancel()
 		})
 	}
 
 	return g.Run()
 }
+
+// runTUI runs the client as a full-screen chat window, sending what's typed and showing the messages of the room.
+func (c *ChatClientCmd) runTUI(conn *grpc.ClientConn, pbClient pb.ChatServerClient, ob *outbox) error {
+	u, err := ulid.New(ulid.Now(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to create a ulid for the client: %w", err)
+	}
+	clientId := u.String()
+
+	// run goroutines
+	g := run.Group{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the latest typing state waiting to be sent, set on the event loop, so it must not block
+	typingChan := make(chan bool, 1)
+	setTyping := func(typing bool) {
+		select {
+		case <-typingChan:
+		default:
+		}
+		select {
+		case typingChan <- typing:
+		default:
+		}
+	}
+
+	// the window itself, it returns when the user quits
+	var ui *chatTUI
+	ui = newChatTUI(func(line string) {
+		switch line {
+		case "/quit":
+			ui.Stop()
+			return
+		case "/who":
+			go func() {
+				lines, err := c.who(ctx, pbClient)
+				if err != nil {
+					ui.AddSystem("failed to list members: %s", status.Convert(err).Message())
+					return
+				}
+				ui.AddEvent("%d members in %s", len(lines), c.Room)
+				for _, line := range lines {
+					ui.AddEvent("%s", line)
+				}
+			}()
+			return
+		}
+		if command, arg, ok := transferCommand(line); ok {
+			// transfers may take a while, the window has to stay responsive
+			go func() {
+				var result string
+				var err error
+				if command == "/upload" {
+					result, err = c.upload(ctx, pbClient, ob, arg)
+					ui.SetStatus("outbox", fmt.Sprint(ob.Len()))
+				} else {
+					result, err = c.download(ctx, pbClient, arg)
+				}
+				if err != nil {
+					ui.AddSystem("%s", err)
+					return
+				}
+				ui.AddEvent("%s", result)
+			}()
+			return
+		}
+		if request, ok, err := c.parseReaction(line); ok {
+			if err != nil {
+				ui.AddSystem("%s", err)
+				return
+			}
+			go func() {
+				if _, err := c.react(ctx, pbClient, request); err != nil {
+					ui.AddSystem("failed to react: %s", status.Convert(err).Message())
+				}
+			}()
+			return
+		}
+		entry, err := c.target(line)
+		if err != nil {
+			ui.AddSystem("%s", err)
+			return
+		}
+		if _, err := ob.Add(entry); err != nil {
+			c.logger.Error("failed to queue message", "err", err)
+			ui.AddSystem("failed to queue message: %s", err)
+			return
+		}
+		ui.SetStatus("outbox", fmt.Sprint(ob.Len()))
+	}, func(text string) {
+		setTyping(text != "" && !strings.HasPrefix(text, "/"))
+	})
+	user := c.User
+	if user == "" {
+		user = anonymousUser
+	}
+	ui.SetStatus("room", c.Room)
+	ui.SetStatus("user", user)
+	ui.SetStatus("outbox", fmt.Sprint(ob.Len()))
+	g.Add(func() error {
+		return ui.Run()
+	}, func(err error) {
+		c.logger.Debug("closing chat window")
+		ui.Stop()
+	})
+
+	// listen for termination signals
+	osSigChan := make(chan os.Signal, 1)
+	signal.Notify(osSigChan, os.Kill, os.Interrupt)
+	done := make(chan struct{})
+	g.Add(func() error {
+		select {
+		case sig := <-osSigChan:
+			c.logger.Debug("caught signal", "signal", sig.String())
+			return fmt.Errorf("received signal: %s", sig.String())
+		case <-done:
+			c.logger.Debug("closing signal catching goroutine")
+		}
+		return nil
+	}, func(err error) {
+		close(done)
+	})
+
+	// tell the other members while the user is typing, refreshing it before the server stops showing it
+	g.Add(func() error {
+		var typing bool
+		var refreshAt time.Time
+		for {
+			select {
+			case t := <-typingChan:
+				if t == typing && (!t || time.Now().Before(refreshAt)) {
+					continue
+				}
+				callCtx, callCancel := context.WithTimeout(ctx, sendTimeout)
+				resp, err := pbClient.SetTyping(callCtx, &pb.SetTypingRequest{Room: c.Room, Typing: t, DisplayName: c.DisplayName})
+				callCancel()
+				if err != nil {
+					c.logger.Debug("failed to send typing state", "err", err)
+					continue
+				}
+				typing = t
+				refreshAt = time.Now().Add(resp.ExpiresIn.AsDuration() / 2)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}, func(err error) {
+		cancel()
+	})
+
+	// send queued messages and show incoming ones, starting with the most recent ones, on a single Chat stream,
+	// reconnecting whenever the connection breaks
+	g.Add(func() error {
+		var lastId int32
+		if rooms, err := pbClient.ListRooms(ctx, &pb.ListRoomsRequest{}); err == nil {
+			for _, r := range rooms.Rooms {
+				if r.Name == c.Room && r.LastId > c.History {
+					lastId = r.LastId - c.History
+				}
+			}
+		}
+		request := &pb.ReceiveRequest{ClientId: clientId, LastId: lastId, Room: c.Room, DisplayName: c.DisplayName}
+		onMessage := func(r *pb.ReceiveResponse) error {
+			if system := r.ChatMessage.GetSystem(); system != nil {
+				ui.AddSystem("%s", system.Text)
+				return nil
+			}
+			if t := r.ChatMessage.GetTyping(); t != nil {
+				ui.SetTyping(memberName(t.User, t.DisplayName), t.Typing)
+				return nil
+			}
+			if m := r.ChatMessage.GetMembership(); m != nil {
+				ui.SetOnline(memberName(m.User, m.DisplayName), m.Kind == pb.MembershipEvent_KIND_JOIN)
+				ui.AddEvent("%s", describe(r.ChatMessage))
+				return nil
+			}
+			if r.ChatMessage.GetReaction() != nil {
+				ui.AddEvent("%s %s", r.ChatMessage.Author, describe(r.ChatMessage))
+				if r.Id > 0 {
+					ui.SetStatus("last id", fmt.Sprint(r.Id))
+				}
+				return nil
+			}
+			ui.AddMessage(r)
+			if r.Id > 0 {
+				ui.SetStatus("last id", fmt.Sprint(r.Id))
+			}
+			return nil
+		}
+		onState := func(state streamState, err error, retryIn time.Duration) {
+			if state == streamConnected {
+				ui.SetStatus("stream", string(state))
+				// members may have come and gone while disconnected
+				ui.ClearTyping()
+				listCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+				defer cancel()
+				if resp, err := pbClient.ListMembers(listCtx, &pb.ListMembersRequest{Room: c.Room}); err == nil {
+					names := make([]string, 0, len(resp.Members))
+					for _, m := range resp.Members {
+						names = append(names, memberName(m.User, m.DisplayName))
+					}
+					ui.SetMembers(names)
+				}
+				return
+			}
+			c.logger.Warn("lost connection to server, reconnecting", "err", err, "retryIn", retryIn)
+			ui.SetStatus("stream", fmt.Sprintf("reconnecting in %s", retryIn.Round(100*time.Millisecond)))
+			ui.AddSystem("lost connection to server: %s", status.Convert(err).Message())
+		}
+		onSent := func(entry outboxEntry, resp *pb.SendResponse) {
+			c.logger.Debug("message sent", "id", resp.Id, "duplicate", resp.Duplicate)
+			ui.SetStatus("outbox", fmt.Sprint(ob.Len()-1))
+		}
+		onError := func(entry outboxEntry, err error) {
+			c.logger.Error("failed to send message", "err", err)
+			ui.AddSystem("failed to send message %q: %s", entry.Message, status.Convert(err).Message())
+		}
+
+		err := chat(ctx, pbClient, request, ob, c.reconnectOptions, chatHandlers{onMessage: onMessage, onState: onState, onSent: onSent, onError: onError})
+		if status.Code(err) == codes.Unimplemented {
+			// servers predating the Chat RPC still have Send and Receive
+			c.logger.Info("server doesn't support chat streams, sending and receiving separately")
+			flushed := make(chan struct{})
+			go func() {
+				defer close(flushed)
+				ob.Flush(ctx, pbClient, c.reconnectOptions, onSent, func(err error, retryIn time.Duration) {
+					c.logger.Warn("failed to send message, retrying", "err", err, "retryIn", retryIn)
+					ui.SetStatus("outbox", fmt.Sprintf("%d, retrying in %s", ob.Len(), retryIn.Round(100*time.Millisecond)))
+				}, onError)
+			}()
+			defer func() { <-flushed }()
+			err = subscribe(ctx, pbClient, request, c.reconnectOptions, onMessage, onState)
+		}
+		if err != nil {
+			c.logger.Error("failed to receive messages", "err", err)
+			ui.AddSystem("stopped receiving messages: %s", err)
+			<-ctx.Done()
+		}
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	// show the state of the connection to the server
+	g.Add(func() error {
+		watchConnection(ctx, conn, func(state connectivity.State) {
+			ui.SetStatus("connection", strings.ToLower(state.String()))
+		})
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	return g.Run()
+}
+
+// target tells where a line typed by the user goes: to the room, directly to a user if it's a "/msg <user> <text>"
+// command, or to a thread if it's a "/reply <id> <text>" command.
+func (c *ChatClientCmd) target(line string) (outboxEntry, error) {
+	command, arg, text, ok := splitCommand(line)
+	switch {
+	case !ok:
+		return outboxEntry{Room: c.Room, Message: line}, nil
+	case command == "/msg":
+		if arg == "" || text == "" {
+			return outboxEntry{}, errors.New("usage: /msg <user> <text>")
+		}
+		return outboxEntry{Recipient: arg, Message: text}, nil
+	default:
+		id, err := strconv.ParseInt(arg, 10, 32)
+		if err != nil || id <= 0 || text == "" {
+			return outboxEntry{}, errors.New("usage: /reply <id> <text>")
+		}
+		return outboxEntry{Room: c.Room, ParentId: int32(id), Message: text}, nil
+	}
+}
+
+// splitCommand splits a "/msg" or "/reply" command into its argument and the text following it.
+func splitCommand(line string) (command, arg, text string, ok bool) {
+	for _, command := range []string{"/msg", "/reply"} {
+		if line != command && !strings.HasPrefix(line, command+" ") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, command)), " ", 2)
+		arg = fields[0]
+		if len(fields) == 2 {
+			text = strings.TrimSpace(fields[1])
+		}
+		return command, arg, text, true
+	}
+	return "", "", "", false
+}
+
+// transferCommand splits an "/upload <path>" or "/download <id>" command, ok tells whether the line is one.
+func transferCommand(line string) (command, arg string, ok bool) {
+	for _, command := range []string{"/upload", "/download"} {
+		if line == command || strings.HasPrefix(line, command+" ") {
+			return command, strings.TrimSpace(strings.TrimPrefix(line, command)), true
+		}
+	}
+	return "", "", false
+}
+
+// upload uploads a file and queues a message to the room with it attached.
+func (c *ChatClientCmd) upload(ctx context.Context, pbClient pb.ChatServerClient, ob *outbox, path string) (string, error) {
+	if path == "" {
+		return "", errors.New("usage: /upload <path>")
+	}
+	attachment, err := uploadFile(ctx, pbClient, path)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Info("uploaded attachment", "id", attachment.Id, "name", attachment.Name, "contentType", attachment.ContentType, "size", attachment.Size)
+	entry := outboxEntry{Room: c.Room, Attachments: []outboxAttachment{{Id: attachment.Id, Name: attachment.Name}}}
+	if _, err := ob.Add(entry); err != nil {
+		return "", fmt.Errorf("failed to queue message: %w", err)
+	}
+	return fmt.Sprintf("uploaded %s (%s, %d bytes) as %s", attachment.Name, attachment.ContentType, attachment.Size, attachment.Id), nil
+}
+
+// download saves an attachment in the download directory.
+func (c *ChatClientCmd) download(ctx context.Context, pbClient pb.ChatServerClient, id string) (string, error) {
+	if id == "" {
+		return "", errors.New("usage: /download <id>")
+	}
+	path, err := downloadFile(ctx, pbClient, id, c.DownloadDir)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Info("downloaded attachment", "id", id, "path", path)
+	return fmt.Sprintf("downloaded %s to %s", id, path), nil
+}
+
+// parseReaction parses a "/react <id> <emoji>" or "/unreact <id> <emoji>" command, ok tells whether the line is one.
+func (c *ChatClientCmd) parseReaction(line string) (request *pb.ReactRequest, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || (fields[0] != "/react" && fields[0] != "/unreact") {
+		return nil, false, nil
+	}
+	if len(fields) != 3 {
+		return nil, true, fmt.Errorf("usage: %s <id> <emoji>", fields[0])
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil || id <= 0 {
+		return nil, true, fmt.Errorf("invalid message id %q", fields[1])
+	}
+	return &pb.ReactRequest{Room: c.Room, MessageId: int32(id), Emoji: fields[2], Remove: fields[0] == "/unreact"}, true, nil
+}
+
+func (c *ChatClientCmd) react(ctx context.Context, pbClient pb.ChatServerClient, request *pb.ReactRequest) (*pb.ReactResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	return pbClient.React(ctx, request)
+}
+
+// who returns a line describing each member of the room.
+func (c *ChatClientCmd) who(ctx context.Context, pbClient pb.ChatServerClient) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	resp, err := pbClient.ListMembers(ctx, &pb.ListMembersRequest{Room: c.Room})
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(resp.Members))
+	for _, m := range resp.Members {
+		line := fmt.Sprintf("%s, connected %s ago, idle %s", memberName(m.User, m.DisplayName),
+			time.Since(m.ConnectedAt.AsTime()).Round(time.Second), m.Idle.AsDuration().Round(time.Second))
+		if m.Streams > 1 {
+			line += fmt.Sprintf(", %d streams", m.Streams)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// clusterSecretHeader carries the cluster secret on calls between the servers of a cluster
+	clusterSecretHeader = "cluster-secret"
+
+	// clusterNodeHeader tells which server of the cluster makes a call
+	clusterNodeHeader = "cluster-node"
+
+	// followerQueueSize is the number of messages buffered for every server following this one, a follower which falls
+	// further behind is disconnected and catches up from the logs when it's back
+	followerQueueSize = 1024
+
+	// replicationWait limits how long a message stored on another server is waited for to be copied here
+	replicationWait = 2 * time.Second
+)
+
+// fanout spreads what happens in the rooms of a server to the subscribers of every server of a cluster. Messages are
+// stored through it, so the messages of a room get their ids in a single place and are in the same order everywhere.
+type fanout interface {
+	// Store stores a message in its room, giving it the next id of the room, and has it broadcast on every server. A
+	// message with an idempotency key which was stored before gets the id of the earlier one and duplicate is true.
+	Store(ctx context.Context, rm *room, msg *pb.ReceiveResponse) (duplicate bool, err error)
+	// Publish hands a message stored, or an event which happened, on this server to the other servers once it was
+	// broadcast here.
+	Publish(rm *room, msg *pb.ReceiveResponse)
+	// RoomChanged tells the other servers that a room was created or deleted.
+	RoomChanged(ctx context.Context, name string, deleted bool)
+}
+
+// localFanout is the fanout of a server on its own, every room is stored and broadcast in process.
+type localFanout struct {
+	messagesChannel chan<- broadcast
+}
+
+func (f localFanout) Store(ctx context.Context, rm *room, msg *pb.ReceiveResponse) (bool, error) {
+	return rm.append(msg, f.messagesChannel)
+}
+
+func (f localFanout) Publish(rm *room, msg *pb.ReceiveResponse) {}
+
+func (f localFanout) RoomChanged(ctx context.Context, name string, deleted bool) {}
+
+// clusterOptions are the cli options of servers forming a cluster with --fanout=mesh.
+type clusterOptions struct {
+	ClusterNode       string   `help:"name of this server in the cluster"`
+	ClusterPeers      []string `help:"the other servers of the cluster as name=address, every server has to list all others"`
+	ClusterSecretFile string   `help:"file with a secret shared by the servers of the cluster, the other servers prove with it that they belong to it" type:"path"`
+}
+
+// meshFanout connects the servers of a cluster directly to each other. Every room is owned by one of them, picked by
+// rendezvous hashing of the room name over the names of all servers, so they agree on it without talking. Messages
+// sent to any server are stored by the owner of their room first, which gives them their ids, and every other server
+// keeps a copy of the owner's log by following it. Events like members joining are passed on the same way by the
+// server they happen on. Typing signals stay on their server.
+type meshFanout struct {
+	s      *ChatServerCmd
+	node   string
+	nodes  []string // all servers of the cluster, including this one
+	peers  map[string]pb.ClusterClient
+	conns  []*grpc.ClientConn
+	secret string
+
+	followers sync.Map // *follower to struct{}
+
+	logger *slog.Logger
+
+	pb.UnimplementedClusterServer
+}
+
+func newMeshFanout(s *ChatServerCmd, options clusterOptions, dialOptions ...grpc.DialOption) (*meshFanout, error) {
+	if options.ClusterNode == "" {
+		return nil, errors.New("--fanout=mesh requires --cluster-node")
+	}
+	m := &meshFanout{s: s, node: options.ClusterNode, nodes: []string{options.ClusterNode}, peers: map[string]pb.ClusterClient{}, logger: s.logger.With("node", options.ClusterNode)}
+	// the cluster methods skip user authentication, without a secret any client could store messages as anyone
+	if options.ClusterSecretFile == "" {
+		return nil, errors.New("--fanout=mesh requires --cluster-secret-file")
+	}
+	data, err := os.ReadFile(options.ClusterSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster secret: %w", err)
+	}
+	m.secret = strings.TrimSpace(string(data))
+	if m.secret == "" {
+		return nil, fmt.Errorf("cluster secret file %s is empty", options.ClusterSecretFile)
+	}
+
+	// servers use their own certificate to connect to the others, which verify it like a client certificate
+	var tlsOptions clientTLSOptions
+	if s.TLSCert != "" {
+		tlsOptions = clientTLSOptions{TLS: true, TLSCert: s.TLSCert, TLSKey: s.TLSKey, TLSCA: s.TLSCA, TLSReloadInterval: s.TLSReloadInterval}
+	}
+	reconnect := reconnectOptions{ReconnectMin: 500 * time.Millisecond, ReconnectMax: 30 * time.Second, Keepalive: 30 * time.Second, KeepaliveTimeout: 10 * time.Second}
+	for _, peer := range options.ClusterPeers {
+		name, addr, ok := strings.Cut(peer, "=")
+		if !ok || name == "" || addr == "" {
+			m.Close()
+			return nil, fmt.Errorf("invalid cluster peer %q, it has to be name=address", peer)
+		}
+		if _, ok := m.peers[name]; ok || name == m.node {
+			m.Close()
+			return nil, fmt.Errorf("cluster node %q is given twice", name)
+		}
+		conn, err := dial(addr, tlsOptions, clientAuthOptions{}, append(reconnect.dialOptions(), dialOptions...)...)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("failed to dial cluster node %s: %w", name, err)
+		}
+		m.conns = append(m.conns, conn)
+		m.peers[name] = pb.NewClusterClient(conn)
+		m.nodes = append(m.nodes, name)
+	}
+	sort.Strings(m.nodes)
+	return m, nil
+}
+
+// owner returns the server owning a room, the one whose hash combined with the room name is the highest.
+func (m *meshFanout) owner(room string) string {
+	var owner string
+	var highest uint64
+	for _, node := range m.nodes {
+		h := fnv.New64a()
+		h.Write([]byte(node))
+		h.Write([]byte{0})
+		h.Write([]byte(room))
+		if sum := h.Sum64(); owner == "" || sum > highest {
+			owner, highest = node, sum
+		}
+	}
+	return owner
+}
+
+// outgoing adds the name of this server and the cluster secret to the context of a call to another server.
+func (m *meshFanout) outgoing(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, clusterNodeHeader, m.node, clusterSecretHeader, m.secret)
+}
+
+// authorize checks that a call comes from another server of the cluster and returns its name.
+func (m *meshFanout) authorize(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(clusterSecretHeader)
+	if len(values) != 1 || subtle.ConstantTimeCompare([]byte(values[0]), []byte(m.secret)) != 1 {
+		return "", status.Error(codes.Unauthenticated, "invalid cluster secret")
+	}
+	values = md.Get(clusterNodeHeader)
+	if len(values) != 1 {
+		return "", status.Error(codes.PermissionDenied, "only other nodes of the cluster may call this")
+	}
+	if _, ok := m.peers[values[0]]; !ok {
+		return "", status.Errorf(codes.PermissionDenied, "%q isn't a node of the cluster", values[0])
+	}
+	return values[0], nil
+}
+
+// room returns a room or conversation by its name. Rooms are only created through UpdateRoom, so a room deleted while
+// its messages are still on their way isn't brought back by them.
+func (m *meshFanout) room(name string) (*room, error) {
+	if strings.HasPrefix(name, "@") {
+		return m.s.directs.open(name)
+	}
+	return m.s.rooms.Get(name)
+}
+
+// rooms returns all rooms and the conversations opened so far.
+func (m *meshFanout) rooms() []*room {
+	return append(m.s.rooms.List(), m.s.directs.List()...)
+}
+
+func (m *meshFanout) Store(ctx context.Context, rm *room, msg *pb.ReceiveResponse) (bool, error) {
+	owner := m.owner(rm.name)
+	if owner == m.node {
+		return rm.append(msg, m.s.messagesChannel)
+	}
+	callCtx, cancel := context.WithTimeout(m.outgoing(ctx), sendTimeout)
+	defer cancel()
+	resp, err := m.peers[owner].Append(callCtx, &pb.ClusterAppendRequest{Room: rm.name, Message: msg})
+	if err != nil {
+		if isRetryable(err) {
+			return false, status.Errorf(codes.Unavailable, "node %s storing the messages of room %s is unavailable: %s", owner, rm.name, status.Convert(err).Message())
+		}
+		return false, err
+	}
+	msg.Id = resp.Id
+	msg.Room = rm.name
+	normalize(msg)
+
+	// the copy comes back by following the owner, waiting for it lets the sender see its message here right away
+	rm.waitReplicated(ctx, resp.Id, replicationWait)
+	return resp.Duplicate, nil
+}
+
+func (m *meshFanout) Publish(rm *room, msg *pb.ReceiveResponse) {
+	if msg.Id != 0 && m.owner(rm.name) != m.node {
+		// stored messages are passed on by the owner of their room only
+		return
+	}
+	item := &pb.FollowResponse{Room: rm.name, Message: msg}
+	m.followers.Range(func(key, value interface{}) bool {
+		key.(*follower).enqueue(item)
+		return true
+	})
+}
+
+func (m *meshFanout) RoomChanged(ctx context.Context, name string, deleted bool) {
+	var wg sync.WaitGroup
+	for node, peer := range m.peers {
+		wg.Add(1)
+		go func(node string, peer pb.ClusterClient) {
+			defer wg.Done()
+			callCtx, cancel := context.WithTimeout(m.outgoing(ctx), sendTimeout)
+			defer cancel()
+			if _, err := peer.UpdateRoom(callCtx, &pb.UpdateRoomRequest{Name: name, Deleted: deleted}); err != nil {
+				m.logger.Warn("failed to update room on another node", "peer", node, "room", name, "deleted", deleted, "err", err)
+			}
+		}(node, peer)
+	}
+	wg.Wait()
+}
+
+// run follows all other servers until ctx is done.
+func (m *meshFanout) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for node, peer := range m.peers {
+		wg.Add(1)
+		go func(node string, peer pb.ClusterClient) {
+			defer wg.Done()
+			m.follow(ctx, node, peer)
+		}(node, peer)
+	}
+	wg.Wait()
+}
+
+// follow keeps copies of the rooms another server owns and passes on the events happening there, reconnecting
+// whenever the stream breaks.
+func (m *meshFanout) follow(ctx context.Context, node string, peer pb.ClusterClient) {
+	b := &backoff{min: 500 * time.Millisecond, max: 30 * time.Second}
+	for {
+		err := m.followOnce(ctx, node, peer, b.Reset)
+		if ctx.Err() != nil {
+			return
+		}
+		delay := b.Next()
+		m.logger.Warn("lost connection to node, reconnecting", "peer", node, "err", err, "retryIn", delay)
+		if err := sleep(ctx, delay); err != nil {
+			return
+		}
+	}
+}
+
+func (m *meshFanout) followOnce(ctx context.Context, node string, peer pb.ClusterClient, onConnected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lastIds := map[string]int32{}
+	for _, rm := range m.rooms() {
+		lastIds[rm.name] = int32(rm.log.LastIndex())
+	}
+	stream, err := peer.Follow(m.outgoing(ctx), &pb.FollowRequest{Node: m.node, LastIds: lastIds})
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+	onConnected()
+	m.logger.Info("following node", "peer", node)
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := m.receive(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// receive takes a message or event from another server.
+func (m *meshFanout) receive(resp *pb.FollowResponse) error {
+	if resp.Message == nil {
+		return nil
+	}
+	m.s.shutdownMu.RLock()
+	defer m.s.shutdownMu.RUnlock()
+	if m.s.shuttingDown {
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	rm, err := m.room(resp.Room)
+	if status.Code(err) == codes.NotFound {
+		// the room was deleted here, or its creation didn't reach this server
+		m.logger.Debug("skipping message of unknown room", "room", resp.Room, "id", resp.Message.Id)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open room %s: %w", resp.Room, err)
+	}
+	if resp.Message.Id == 0 {
+		m.s.messagesChannel <- broadcast{room: rm, msg: resp.Message, remote: true}
+		return nil
+	}
+	return rm.replicate(resp.Message, m.s.messagesChannel)
+}
+
+func (m *meshFanout) Append(ctx context.Context, request *pb.ClusterAppendRequest) (*pb.ClusterAppendResponse, error) {
+	if _, err := m.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if request.Message == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing message")
+	}
+	if owner := m.owner(request.Room); owner != m.node {
+		return nil, status.Errorf(codes.FailedPrecondition, "room %s is owned by node %s, the cluster is configured inconsistently", request.Room, owner)
+	}
+	rm, err := m.room(request.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	m.s.shutdownMu.RLock()
+	defer m.s.shutdownMu.RUnlock()
+	if m.s.shuttingDown {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	msg := request.Message
+	duplicate, err := rm.append(msg, m.s.messagesChannel)
+	if err != nil {
+		m.logger.Error("failed to append message to log", "room", rm.name, "err", err)
+		m.s.metrics.sendFailures.WithLabelValues("append").Inc()
+		return nil, err
+	}
+	return &pb.ClusterAppendResponse{Id: msg.Id, Duplicate: duplicate}, nil
+}
+
+func (m *meshFanout) Follow(request *pb.FollowRequest, server pb.Cluster_FollowServer) error {
+	node, err := m.authorize(server.Context())
+	if err != nil {
+		return err
+	}
+	if request.Node != node {
+		return status.Errorf(codes.PermissionDenied, "node %s can't follow as %s", node, request.Node)
+	}
+	// conversations are opened when they're used, the follower may know some which weren't used here since a restart
+	for name := range request.LastIds {
+		if strings.HasPrefix(name, "@") && m.owner(name) == m.node {
+			if _, err := m.s.directs.open(name); err != nil {
+				m.logger.Error("failed to open conversation", "room", name, "err", err)
+			}
+		}
+	}
+
+	// follow before replaying the logs, so no message falls in between, duplicates are skipped by id below
+	f := &follower{node: request.Node, queue: make(chan *pb.FollowResponse, followerQueueSize), finishedChannel: make(chan struct{})}
+	m.followers.Store(f, struct{}{})
+	defer m.followers.Delete(f)
+	if err := server.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	m.logger.Info("node is following", "peer", request.Node)
+
+	sent := map[string]int32{}
+	for _, rm := range m.rooms() {
+		if m.owner(rm.name) != m.node {
+			continue
+		}
+		sent[rm.name] = request.LastIds[rm.name]
+		err := rm.read(request.LastIds[rm.name], func(msg *pb.ReceiveResponse) error {
+			sent[rm.name] = msg.Id
+			return server.Send(&pb.FollowResponse{Room: rm.name, Message: msg})
+		})
+		if err != nil {
+			m.logger.Error("failed to replay message log to node", "peer", request.Node, "room", rm.name, "err", err)
+			return err
+		}
+	}
+
+	for {
+		select {
+		case item := <-f.queue:
+			if item.Message.Id != 0 && item.Message.Id <= sent[item.Room] {
+				continue
+			}
+			if err := server.Send(item); err != nil {
+				return err
+			}
+		case <-f.finishedChannel:
+			m.logger.Warn("disconnecting node", "peer", request.Node, "reason", f.err)
+			return f.err
+		case <-m.s.shutdownChannel:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-server.Context().Done():
+			m.logger.Info("node stopped following", "peer", request.Node)
+			return nil
+		}
+	}
+}
+
+func (m *meshFanout) UpdateRoom(ctx context.Context, request *pb.UpdateRoomRequest) (*pb.UpdateRoomResponse, error) {
+	if _, err := m.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if request.Deleted {
+		if err := m.s.rooms.Delete(request.Name); err != nil && status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		m.logger.Info("deleted room of another node", "room", request.Name)
+		return &pb.UpdateRoomResponse{}, nil
+	}
+	if _, err := m.s.rooms.Create(request.Name); err != nil && status.Code(err) != codes.AlreadyExists {
+		return nil, err
+	}
+	m.logger.Info("created room of another node", "room", request.Name)
+	return &pb.UpdateRoomResponse{}, nil
+}
+
+func (m *meshFanout) Close() {
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// follower is another server following this one.
+type follower struct {
+	node            string
+	queue           chan *pb.FollowResponse
+	finishedChannel chan struct{}
+	finishOnce      sync.Once
+	err             error
+}
+
+// enqueue puts a message on the follower's queue without blocking, a follower which is too far behind is disconnected.
+func (f *follower) enqueue(item *pb.FollowResponse) {
+	select {
+	case f.queue <- item:
+	default:
+		f.finishOnce.Do(func() {
+			f.err = status.Error(codes.ResourceExhausted, "node fell behind")
+			close(f.finishedChannel)
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// writeClusterSecret writes a cluster secret to a file and returns its path.
+func writeClusterSecret(t *testing.T) string {
+	t.Helper()
+	secretFile := filepath.Join(t.TempDir(), "cluster-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return secretFile
+}
+
+// testCluster connects in-process servers over bufconn listeners, addressed by the names of their nodes.
+type testCluster struct {
+	t          *testing.T
+	nodes      []string
+	secretFile string
+
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener
+}
+
+func newTestCluster(t *testing.T, nodes ...string) *testCluster {
+	return &testCluster{t: t, nodes: nodes, secretFile: writeClusterSecret(t), listeners: map[string]*bufconn.Listener{}}
+}
+
+func (c *testCluster) dial(ctx context.Context, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	lis := c.listeners[addr]
+	c.mu.Unlock()
+	if lis == nil {
+		return nil, fmt.Errorf("node %s isn't running", addr)
+	}
+	return lis.DialContext(ctx)
+}
+
+// testNode is a server of a testCluster.
+type testNode struct {
+	*testServer
+	mesh *meshFanout
+}
+
+// start runs the server of a node storing its rooms in dir.
+func (c *testCluster) start(name, dir string) *testNode {
+	t := c.t
+	s := newTestServer(t, dir)
+	var peers []string
+	for _, node := range c.nodes {
+		if node != name {
+			peers = append(peers, node+"="+node)
+		}
+	}
+	mesh, err := newMeshFanout(s, clusterOptions{ClusterNode: name, ClusterPeers: peers, ClusterSecretFile: c.secretFile}, grpc.WithContextDialer(c.dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mesh.Close)
+	s.fanout = mesh
+
+	lis := bufconn.Listen(1 << 20)
+	c.mu.Lock()
+	c.listeners[name] = lis
+	c.mu.Unlock()
+	register := func(srv *grpc.Server) { pb.RegisterClusterServer(srv, mesh) }
+	dial := func(ctx context.Context, _ string) (net.Conn, error) { return c.dial(ctx, name) }
+	return &testNode{testServer: serveTest(t, s, lis, dial, register, mesh.run), mesh: mesh}
+}
+
+// waitForFollowers waits until every node of the cluster is followed by all others.
+func waitForFollowers(t *testing.T, nodes ...*testNode) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range nodes {
+		for {
+			followers := 0
+			n.mesh.followers.Range(func(key, value interface{}) bool {
+				followers++
+				return true
+			})
+			if followers == len(n.mesh.peers) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s has %d followers, want %d", n.mesh.node, followers, len(n.mesh.peers))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// roomOwnedBy returns the name of a room which the given node owns.
+func roomOwnedBy(t *testing.T, m *meshFanout, node string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("room-%d", i)
+		if m.owner(name) == node {
+			return name
+		}
+	}
+	t.Fatalf("no room is owned by %s", node)
+	return ""
+}
+
+// waitForMessage receives from a stream until the message with the given id arrives.
+func waitForMessage(t *testing.T, stream pb.ChatServer_ReceiveClient, id int32, text string) {
+	t.Helper()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("stream ended before message %d arrived: %v", id, err)
+		}
+		if msg.Id != id {
+			continue
+		}
+		if got := msg.ChatMessage.GetText().GetText(); got != text {
+			t.Fatalf("message %d is %q, want %q", id, got, text)
+		}
+		return
+	}
+}
+
+// waitForLastId waits until a room has stored the message with the given id.
+func waitForLastId(t *testing.T, rm *room, id int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for int32(rm.log.LastIndex()) < id {
+		if time.Now().After(deadline) {
+			t.Fatalf("room %s has %d messages, want %d", rm.name, rm.log.LastIndex(), id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMeshSendToOtherNode(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b")
+	a := cluster.start("a", t.TempDir())
+	b := cluster.start("b", t.TempDir())
+	waitForFollowers(t, a, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a room owned by b, created on a and passed on to b
+	name := roomOwnedBy(t, a.mesh, "b")
+	if _, err := a.client.CreateRoom(ctx, &pb.CreateRoomRequest{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.s.rooms.Get(name); err != nil {
+		t.Fatalf("room wasn't created on the other node: %v", err)
+	}
+
+	var streams []pb.ChatServer_ReceiveClient
+	for _, n := range []*testNode{a, b} {
+		stream, err := n.client.Receive(ctx, &pb.ReceiveRequest{Room: name, ClientId: "subscriber"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Header(); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+
+	// messages sent to both nodes get their ids from b, in the order b stored them
+	var ids []int32
+	for i, n := range []*testNode{b, a, a} {
+		resp, err := n.client.Send(ctx, &pb.SendRequest{Room: name, Message: fmt.Sprintf("message %d", i), IdempotencyKey: fmt.Sprintf("key-%d", i)})
+		if err != nil {
+			t.Fatalf("send %d failed: %v", i, err)
+		}
+		ids = append(ids, resp.Id)
+	}
+	if ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Fatalf("messages got ids %v, want [1 2 3]", ids)
+	}
+	for _, stream := range streams {
+		for i, id := range ids {
+			waitForMessage(t, stream, id, fmt.Sprintf("message %d", i))
+		}
+	}
+
+	// a retry through the other node is recognized by the owner
+	resp, err := a.client.Send(ctx, &pb.SendRequest{Room: name, Message: "message 0", IdempotencyKey: "key-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Duplicate || resp.Id != ids[0] {
+		t.Fatalf("retry got id %d, duplicate %v, want id %d of the first attempt", resp.Id, resp.Duplicate, ids[0])
+	}
+	onB, _ := b.s.rooms.Get(name)
+	if last := onB.log.LastIndex(); last != 3 {
+		t.Fatalf("owner stored %d messages, want 3", last)
+	}
+}
+
+func TestMeshFollowerCatchesUp(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b")
+	a := cluster.start("a", t.TempDir())
+	dirB := t.TempDir()
+	b := cluster.start("b", dirB)
+	waitForFollowers(t, a, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := roomOwnedBy(t, a.mesh, "a")
+	if _, err := a.client.CreateRoom(ctx, &pb.CreateRoomRequest{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.client.Send(ctx, &pb.SendRequest{Room: name, Message: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	onB, err := b.s.rooms.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLastId(t, onB, 1)
+
+	// b misses messages while it's down
+	b.stop()
+	for i := 0; i < 5; i++ {
+		if _, err := a.client.Send(ctx, &pb.SendRequest{Room: name, Message: fmt.Sprintf("missed %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// and copies them from a once it's back
+	b = cluster.start("b", dirB)
+	onB, err = b.s.rooms.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLastId(t, onB, 6)
+
+	// later messages follow
+	resp, err := a.client.Send(ctx, &pb.SendRequest{Room: name, Message: "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLastId(t, onB, resp.Id)
+
+	onA, _ := a.s.rooms.Get(name)
+	var want, got []string
+	for _, c := range []struct {
+		rm    *room
+		texts *[]string
+	}{{onA, &want}, {onB, &got}} {
+		texts := c.texts
+		err := c.rm.read(0, func(msg *pb.ReceiveResponse) error {
+			*texts = append(*texts, fmt.Sprintf("%d %s", msg.Id, msg.ChatMessage.GetText().GetText()))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("copy of the room has %v, want %v", got, want)
+	}
+}
+
+func TestMeshAuthorize(t *testing.T) {
+	s := &ChatServerCmd{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	m, err := newMeshFanout(s, clusterOptions{ClusterNode: "a", ClusterPeers: []string{"b=b"}, ClusterSecretFile: writeClusterSecret(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	incoming := func(pairs ...string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+	}
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{name: "peer", ctx: incoming(clusterSecretHeader, "secret", clusterNodeHeader, "b")},
+		{name: "no secret", ctx: incoming(clusterNodeHeader, "b"), code: codes.Unauthenticated},
+		{name: "wrong secret", ctx: incoming(clusterSecretHeader, "guess", clusterNodeHeader, "b"), code: codes.Unauthenticated},
+		{name: "no node", ctx: incoming(clusterSecretHeader, "secret"), code: codes.PermissionDenied},
+		{name: "unknown node", ctx: incoming(clusterSecretHeader, "secret", clusterNodeHeader, "c"), code: codes.PermissionDenied},
+		{name: "itself", ctx: incoming(clusterSecretHeader, "secret", clusterNodeHeader, "a"), code: codes.PermissionDenied},
+	} {
+		_, err := m.Append(tc.ctx, &pb.ClusterAppendRequest{Room: roomOwnedBy(t, m, "a")})
+		if tc.code == codes.OK {
+			// authorized calls get as far as checking the request
+			tc.code = codes.InvalidArgument
+		}
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.code)
+		}
+	}
+}
+
+func TestMeshRequiresSecret(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "cluster-secret")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &ChatServerCmd{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	for _, secretFile := range []string{"", empty, filepath.Join(t.TempDir(), "missing")} {
+		if _, err := newMeshFanout(s, clusterOptions{ClusterNode: "a", ClusterSecretFile: secretFile}); err == nil {
+			t.Errorf("mesh was set up with secret file %q", secretFile)
+		}
+	}
+}
+
+func TestMeshSkipsUnknownRooms(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	t.Cleanup(func() {
+		s.rooms.Close()
+		s.directs.Close()
+	})
+	m, err := newMeshFanout(s, clusterOptions{ClusterNode: "a", ClusterPeers: []string{"b=b"}, ClusterSecretFile: writeClusterSecret(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// messages of rooms which don't exist here don't create them, creating rooms is left to UpdateRoom
+	cm := textMessage("hello")
+	cm.Timestamp = timestamppb.Now()
+	if err := m.receive(&pb.FollowResponse{Room: "deleted", Message: &pb.ReceiveResponse{Id: 1, ChatMessage: cm}}); err != nil {
+		t.Fatalf("message of an unknown room ended following: %v", err)
+	}
+	if _, err := s.rooms.Get("deleted"); status.Code(err) != codes.NotFound {
+		t.Fatalf("message of an unknown room created it: %v", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(clusterSecretHeader, "secret", clusterNodeHeader, "b"))
+	if _, err := m.Append(ctx, &pb.ClusterAppendRequest{Room: roomOwnedBy(t, m, "a"), Message: &pb.ReceiveResponse{ChatMessage: cm}}); status.Code(err) != codes.NotFound {
+		t.Fatalf("appending to an unknown room gave %v, want NotFound", err)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	rm, err := openRoom(t.TempDir(), "general", roomOptions{segmentSize: 1 << 20, syncMode: walSyncNever, syncInterval: time.Second, dedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.log.Close()
+	messages := make(chan broadcast, 10)
+	newMessage := func(id int32) *pb.ReceiveResponse {
+		cm := textMessage(fmt.Sprintf("message %d", id))
+		cm.Timestamp = timestamppb.Now()
+		return &pb.ReceiveResponse{Id: id, ChatMessage: cm}
+	}
+
+	for _, id := range []int32{1, 2, 2, 1} {
+		if err := rm.replicate(newMessage(id), messages); err != nil {
+			t.Fatalf("replicating %d failed: %v", id, err)
+		}
+	}
+	if last := rm.log.LastIndex(); last != 2 {
+		t.Fatalf("log has %d messages, want 2", last)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("%d messages were broadcast, want 2", len(messages))
+	}
+	if b := <-messages; !b.remote {
+		t.Fatal("copied message is passed on to the other servers again")
+	}
+	if err := rm.replicate(newMessage(4), messages); err == nil {
+		t.Fatal("gap in the copied messages wasn't noticed")
+	}
+}
+
+func TestWaitReplicated(t *testing.T) {
+	rm, err := openRoom(t.TempDir(), "general", roomOptions{segmentSize: 1 << 20, syncMode: walSyncNever, syncInterval: time.Second, dedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.log.Close()
+	messages := make(chan broadcast, 10)
+	ctx := context.Background()
+
+	if rm.waitReplicated(ctx, 1, 10*time.Millisecond) {
+		t.Fatal("message which never arrived was waited for")
+	}
+	done := make(chan bool)
+	go func() { done <- rm.waitReplicated(ctx, 2, 5*time.Second) }()
+	for id := int32(1); id <= 2; id++ {
+		cm := textMessage(fmt.Sprintf("message %d", id))
+		cm.Timestamp = timestamppb.Now()
+		if err := rm.replicate(&pb.ReceiveResponse{Id: id, ChatMessage: cm}, messages); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !<-done {
+		t.Fatal("waiting for a replicated message timed out")
+	}
+	if !rm.waitReplicated(ctx, 1, 0) {
+		t.Fatal("message which is there already was waited for")
+	}
+}
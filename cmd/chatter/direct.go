@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	pb "github.com/mwasilew2/chatter/gen"
+)
+
+// directMetricsRoom is the room label of the metrics of direct messages, so conversations don't each get their own
+// series.
+const directMetricsRoom = "@direct"
+
+// conversations holds the message logs of direct messages, one per pair of users. They're rooms without subscribers
+// of their own, opened when they're first used.
+type conversations struct {
+	dir     string
+	options roomOptions
+
+	mu    sync.Mutex
+	rooms map[string]*room
+}
+
+func openConversations(dir string, options roomOptions) (*conversations, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create conversations directory: %w", err)
+	}
+	return &conversations{dir: dir, options: options, rooms: map[string]*room{}}, nil
+}
+
+// conversationName returns the name of the conversation between two users, which is the same whoever of them asks.
+func conversationName(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return fmt.Sprintf("@%s,%s", a, b)
+}
+
+// Get returns the conversation between two users, opening its message log if needed.
+func (c *conversations) Get(a, b string) (*room, error) {
+	return c.open(conversationName(a, b))
+}
+
+// open returns a conversation by its name, opening its message log if needed.
+func (c *conversations) open(name string) (*room, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rm, ok := c.rooms[name]; ok {
+		return rm, nil
+	}
+	// user names may contain anything, so the directory is named after a hash of the conversation name
+	sum := sha256.Sum256([]byte(name))
+	rm, err := openRoom(filepath.Join(c.dir, hex.EncodeToString(sum[:])), name, c.options)
+	if err != nil {
+		return nil, err
+	}
+	c.rooms[name] = rm
+	return rm, nil
+}
+
+// List returns the conversations opened so far.
+func (c *conversations) List() []*room {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rooms := make([]*room, 0, len(c.rooms))
+	for _, rm := range c.rooms {
+		rooms = append(rooms, rm)
+	}
+	return rooms
+}
+
+func (c *conversations) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for _, rm := range c.rooms {
+		if err := rm.log.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// inboxes keeps track of the streams of every user, to deliver direct messages on. A client receiving several rooms
+// has a stream in each of them, but gets every direct message on one of them only.
+type inboxes struct {
+	mu    sync.Mutex
+	users map[string]map[string][]*subscriber // user to client to its streams, oldest first
+}
+
+func newInboxes() *inboxes {
+	return &inboxes{users: map[string]map[string][]*subscriber{}}
+}
+
+// inboxClient returns what tells the clients of a user apart, the session stands in for clients without an id.
+func inboxClient(sub *subscriber) string {
+	if sub.clientId != "" {
+		return sub.clientId
+	}
+	return sub.sessionId
+}
+
+func (in *inboxes) add(sub *subscriber) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	clients, ok := in.users[sub.member.user]
+	if !ok {
+		clients = map[string][]*subscriber{}
+		in.users[sub.member.user] = clients
+	}
+	client := inboxClient(sub)
+	clients[client] = append(clients[client], sub)
+}
+
+func (in *inboxes) remove(sub *subscriber) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	clients := in.users[sub.member.user]
+	client := inboxClient(sub)
+	streams := clients[client]
+	for i, other := range streams {
+		if other == sub {
+			streams = append(streams[:i:i], streams[i+1:]...)
+			break
+		}
+	}
+	if len(streams) > 0 {
+		clients[client] = streams
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(in.users, sub.member.user)
+	}
+}
+
+// streams returns a stream of every client of a user.
+func (in *inboxes) streams(user string) []*subscriber {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var subs []*subscriber
+	for _, streams := range in.users[user] {
+		subs = append(subs, streams[0])
+	}
+	return subs
+}
+
+// deliverDirect queues a direct message for a stream of every client of its author and recipient, whichever room the
+// stream receives. The message keeps the name and id of its conversation, so it doesn't move the stream's position in
+// its room.
+func (s *ChatServerCmd) deliverDirect(msg *pb.ReceiveResponse) {
+	cm := msg.ChatMessage
+	delivered := &pb.ReceiveResponse{Room: msg.Room, IdempotencyKey: msg.IdempotencyKey, ChatMessage: cm}
+	normalize(delivered)
+	users := []string{cm.Author}
+	if cm.Recipient != cm.Author {
+		users = append(users, cm.Recipient)
+	}
+	for _, user := range users {
+		for _, sub := range s.inboxes.streams(user) {
+			if !sub.enqueue(delivered) {
+				s.droppedMessages.Add(1)
+				s.metrics.messagesDropped.WithLabelValues(directMetricsRoom, string(sub.policy)).Inc()
+				s.logger.Debug("subscriber queue overflow", "clientId", sub.clientId, "conversation", msg.Room, "policy", sub.policy, "dropped", sub.dropped.Load())
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// messageEdits tracks which messages of a room were edited or deleted. The log is append-only, so edits and deletions
+// are stored as events referring to the original id, and messages read from the log are shown as they are now.
+type messageEdits struct {
+	mu       sync.RWMutex
+	messages map[int32]*editedMessage
+}
+
+type editedMessage struct {
+	edits   []*pb.ChatMessage // edit events, oldest first
+	deleted bool
+}
+
+func newMessageEdits() *messageEdits {
+	return &messageEdits{messages: map[int32]*editedMessage{}}
+}
+
+func (e *messageEdits) get(id int32) *editedMessage {
+	m, ok := e.messages[id]
+	if !ok {
+		m = &editedMessage{}
+		e.messages[id] = m
+	}
+	return m
+}
+
+// edit records an edit event.
+func (e *messageEdits) edit(event *pb.ChatMessage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := e.get(event.GetEdit().GetMessageId())
+	m.edits = append(m.edits, event)
+}
+
+// delete records the deletion of a message, forgetting its edits. Deleting only turns a message into a tombstone where
+// it's shown, the log is append-only so its text stays in the stored record, which is also passed on as it is to the
+// other servers of a cluster. History, search, threads and replays to clients don't show it anymore.
+func (e *messageEdits) delete(id int32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := e.get(id)
+	m.edits = nil
+	m.deleted = true
+}
+
+// apply turns a stored message into what it is now, a tombstone if it was deleted or its latest text with the
+// earlier ones as revisions if it was edited, and tells whether anything changed.
+func (e *messageEdits) apply(cm *pb.ChatMessage) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	m, ok := e.messages[cm.Id]
+	if !ok {
+		return false
+	}
+	if m.deleted {
+		cm.Payload = nil
+		cm.ContentType = ""
+		cm.Attachments = nil
+		cm.Deleted = true
+		return true
+	}
+	if len(m.edits) == 0 {
+		return false
+	}
+	cm.Revisions = append(cm.Revisions, &pb.Revision{Text: cm.GetText().GetText(), Author: cm.Author, Timestamp: cm.Timestamp})
+	for _, event := range m.edits[:len(m.edits)-1] {
+		cm.Revisions = append(cm.Revisions, &pb.Revision{Text: event.GetEdit().GetText(), Author: event.Author, Timestamp: event.Timestamp})
+	}
+	latest := m.edits[len(m.edits)-1]
+	cm.Payload = &pb.ChatMessage_Text{Text: &pb.TextPayload{Text: latest.GetEdit().GetText()}}
+	cm.EditedAt = latest.Timestamp
+	return true
+}
+
+// track updates what's kept in memory about the messages of a room with a message just stored or read from the log.
+func (rm *room) track(cm *pb.ChatMessage) {
+	switch p := cm.Payload.(type) {
+	case *pb.ChatMessage_Text:
+		rm.index.add(cm)
+		if cm.ParentId != 0 {
+			rm.threads.add(cm.ParentId, cm.Id)
+		}
+	case *pb.ChatMessage_Edit:
+		rm.edits.edit(cm)
+		rm.index.update(p.Edit.MessageId, p.Edit.Text)
+	case *pb.ChatMessage_Delete:
+		rm.edits.delete(p.Delete.MessageId)
+		rm.reactions.clear(p.Delete.MessageId)
+		rm.threads.remove(p.Delete.MessageId)
+		rm.index.remove(p.Delete.MessageId)
+	case *pb.ChatMessage_Reaction:
+		rm.reactions.record(p.Reaction.MessageId, p.Reaction.Emoji, cm.Author, p.Reaction.Removed)
+	}
+}
+
+// isAdmin tells whether a user may edit and delete the messages of others.
+func (s *ChatServerCmd) isAdmin(user string) bool {
+	for _, admin := range s.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// message returns a text message of a room, which hasn't been deleted, for an event referring to it.
+func (s *ChatServerCmd) message(rm *room, id int32) (*pb.ChatMessage, error) {
+	if id <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid message id")
+	}
+	messages, err := rm.messages([]int32{id})
+	if err != nil {
+		s.logger.Error("failed to read message log", "room", rm.name, "err", err)
+		return nil, status.Error(codes.Internal, "failed to read message log")
+	}
+	if len(messages) == 0 {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", id)
+	}
+	cm := messages[0]
+	if cm.Deleted {
+		return nil, status.Errorf(codes.FailedPrecondition, "message %d was deleted", id)
+	}
+	if cm.GetText() == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "message %d is not a text message", id)
+	}
+	return cm, nil
+}
+
+// editable returns a message the caller is about to edit or delete, after checking it may.
+func (s *ChatServerCmd) editable(ctx context.Context, rm *room, id int32) (*pb.ChatMessage, error) {
+	cm, err := s.message(rm, id)
+	if err != nil {
+		return nil, err
+	}
+	if user := userFromContext(ctx); cm.Author != user && !s.isAdmin(user) {
+		return nil, status.Errorf(codes.PermissionDenied, "only the author of message %d or an admin may change it", id)
+	}
+	return cm, nil
+}
+
+// storeEvent stores an event referring to an earlier message, like an edit, in the room of that message and broadcasts
+// it.
+func (s *ChatServerCmd) storeEvent(ctx context.Context, rm *room, original, cm *pb.ChatMessage) (*pb.ReceiveResponse, error) {
+	cm.Version = envelopeVersion
+	cm.Author = userFromContext(ctx)
+	cm.Timestamp = timestamppb.Now()
+	if original.Recipient != "" {
+		// the event goes to both sides of the conversation like the message did, seen from whoever changes it
+		cm.Recipient = original.Recipient
+		if cm.Author == original.Recipient {
+			cm.Recipient = original.Author
+		}
+	}
+	msg := &pb.ReceiveResponse{ChatMessage: cm}
+
+	s.shutdownMu.RLock()
+	defer s.shutdownMu.RUnlock()
+	if s.shuttingDown {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	if _, err := s.fanout.Store(ctx, rm, msg); err != nil {
+		s.logger.Error("failed to append message to log", "room", rm.name, "err", err)
+		s.metrics.sendFailures.WithLabelValues("append").Inc()
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *ChatServerCmd) EditMessage(ctx context.Context, request *pb.EditMessageRequest) (*pb.EditMessageResponse, error) {
+	if request.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text can't be empty")
+	}
+	rm, err := s.roomOrConversation(ctx, request.Room, request.Peer)
+	if err != nil {
+		return nil, err
+	}
+	original, err := s.editable(ctx, rm, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.storeEvent(ctx, rm, original, &pb.ChatMessage{
+		ContentType: original.ContentType,
+		Payload:     &pb.ChatMessage_Edit{Edit: &pb.EditEvent{MessageId: original.Id, Text: request.Text}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("edited message", "room", rm.name, "id", original.Id, "editor", msg.ChatMessage.Author, "eventId", msg.Id)
+
+	messages, err := rm.messages([]int32{original.Id})
+	if err != nil || len(messages) == 0 {
+		s.logger.Error("failed to read edited message", "room", rm.name, "id", original.Id, "err", err)
+		return &pb.EditMessageResponse{Id: msg.Id}, nil
+	}
+	return &pb.EditMessageResponse{Id: msg.Id, Message: messages[0]}, nil
+}
+
+func (s *ChatServerCmd) DeleteMessage(ctx context.Context, request *pb.DeleteMessageRequest) (*pb.DeleteMessageResponse, error) {
+	rm, err := s.roomOrConversation(ctx, request.Room, request.Peer)
+	if err != nil {
+		return nil, err
+	}
+	original, err := s.editable(ctx, rm, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.storeEvent(ctx, rm, original, &pb.ChatMessage{
+		Payload: &pb.ChatMessage_Delete{Delete: &pb.DeleteEvent{MessageId: original.Id}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("deleted message", "room", rm.name, "id", original.Id, "by", msg.ChatMessage.Author, "eventId", msg.Id)
+	return &pb.DeleteMessageResponse{Id: msg.Id}, nil
+}
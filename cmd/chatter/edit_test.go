@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestApplyEdits(t *testing.T) {
+	edits := newMessageEdits()
+	at := func(minutes int) *timestamppb.Timestamp {
+		return timestamppb.New(historyEpoch.Add(time.Duration(minutes) * time.Minute))
+	}
+	editEvent := func(text, author string, minutes int) *pb.ChatMessage {
+		return &pb.ChatMessage{Author: author, Timestamp: at(minutes), Payload: &pb.ChatMessage_Edit{Edit: &pb.EditEvent{MessageId: 1, Text: text}}}
+	}
+	original := func() *pb.ChatMessage {
+		cm := textMessage("first")
+		cm.Id, cm.Author, cm.Timestamp = 1, "alice", at(0)
+		return cm
+	}
+
+	untouched := textMessage("other")
+	untouched.Id = 2
+	if edits.apply(untouched) {
+		t.Fatal("message which wasn't edited was changed")
+	}
+
+	edits.edit(editEvent("second", "alice", 1))
+	edits.edit(editEvent("third", "bob", 2))
+	cm := original()
+	if !edits.apply(cm) {
+		t.Fatal("edited message wasn't changed")
+	}
+	if text := cm.GetText().GetText(); text != "third" {
+		t.Fatalf("edited message has text %q, want the latest one", text)
+	}
+	if !cm.EditedAt.AsTime().Equal(at(2).AsTime()) {
+		t.Fatalf("edited at %s, want the time of the latest edit", cm.EditedAt.AsTime())
+	}
+	want := []struct{ text, author string }{{"first", "alice"}, {"second", "alice"}}
+	if len(cm.Revisions) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(cm.Revisions), len(want))
+	}
+	for i, revision := range cm.Revisions {
+		if revision.Text != want[i].text || revision.Author != want[i].author {
+			t.Errorf("revision %d is %q by %s, want %q by %s", i, revision.Text, revision.Author, want[i].text, want[i].author)
+		}
+	}
+
+	edits.delete(1)
+	cm = original()
+	if !edits.apply(cm) {
+		t.Fatal("deleted message wasn't changed")
+	}
+	if !cm.Deleted || cm.Payload != nil || cm.ContentType != "" || len(cm.Revisions) != 0 {
+		t.Fatalf("deleted message is %v, want a tombstone", cm)
+	}
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.auth, _ = newTestAuthenticator(t, time.Hour)
+	s.Admins = []string{"bob"}
+	ts := startTestServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	alice, bob := asUser(ctx, "alice"), asUser(ctx, "bob")
+
+	send := func(ctx context.Context, text string) int32 {
+		t.Helper()
+		resp, err := ts.client.Send(ctx, &pb.SendRequest{Message: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Id
+	}
+	history := func() map[int32]*pb.ChatMessage {
+		t.Helper()
+		resp, err := ts.client.History(alice, &pb.HistoryRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := map[int32]*pb.ChatMessage{}
+		for _, cm := range resp.Messages {
+			messages[cm.Id] = cm
+		}
+		return messages
+	}
+	search := func(query string) []int32 {
+		t.Helper()
+		resp, err := ts.client.Search(alice, &pb.SearchRequest{Query: query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int32
+		for _, result := range resp.Results {
+			ids = append(ids, result.Message.Id)
+		}
+		return ids
+	}
+
+	byAlice := send(alice, "hello world")
+	byBob := send(bob, "secret plans")
+
+	// authors edit their own messages
+	resp, err := ts.client.EditMessage(alice, &pb.EditMessageRequest{MessageId: byAlice, Text: "hello there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := resp.Message.GetText().GetText(); text != "hello there" {
+		t.Fatalf("edit returned the message with text %q", text)
+	}
+	cm := history()[byAlice]
+	if cm.GetText().GetText() != "hello there" || len(cm.Revisions) != 1 || cm.Revisions[0].Text != "hello world" || cm.EditedAt == nil {
+		t.Fatalf("history has the edited message as %v", cm)
+	}
+	if ids := search("world"); len(ids) != 0 {
+		t.Fatalf("search found the text before the edit in %v", ids)
+	}
+	if ids := search("there"); len(ids) != 1 || ids[0] != byAlice {
+		t.Fatalf("search for the edited text found %v", ids)
+	}
+
+	// others don't, unless they're admins
+	_, err = ts.client.EditMessage(alice, &pb.EditMessageRequest{MessageId: byBob, Text: "no plans"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("editing the message of another user gave %v, want PermissionDenied", err)
+	}
+	_, err = ts.client.DeleteMessage(alice, &pb.DeleteMessageRequest{MessageId: byBob})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("deleting the message of another user gave %v, want PermissionDenied", err)
+	}
+	if _, err := ts.client.EditMessage(bob, &pb.EditMessageRequest{MessageId: byAlice, Text: "hello, edited by an admin"}); err != nil {
+		t.Fatalf("admin couldn't edit the message of another user: %v", err)
+	}
+
+	// deleted messages are tombstones in history and can't be found
+	if _, err := ts.client.DeleteMessage(bob, &pb.DeleteMessageRequest{MessageId: byBob}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.client.DeleteMessage(bob, &pb.DeleteMessageRequest{MessageId: byAlice}); err != nil {
+		t.Fatalf("admin couldn't delete the message of another user: %v", err)
+	}
+	messages := history()
+	for _, id := range []int32{byAlice, byBob} {
+		cm := messages[id]
+		if cm == nil || !cm.Deleted || cm.Payload != nil || len(cm.Revisions) != 0 {
+			t.Fatalf("history has deleted message %d as %v, want a tombstone", id, cm)
+		}
+	}
+	for _, query := range []string{"secret", "plans", "hello", "edited"} {
+		if ids := search(query); len(ids) != 0 {
+			t.Fatalf("search for %q found deleted messages %v", query, ids)
+		}
+	}
+	_, err = ts.client.EditMessage(alice, &pb.EditMessageRequest{MessageId: byAlice, Text: "back"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("editing a deleted message gave %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// envelopeVersion is the version of pb.ChatMessage written by the server.
+	envelopeVersion = 1
+
+	contentTypeText     = "text/plain"
+	contentTypeMarkdown = "text/markdown"
+)
+
+// textMessage wraps text in an envelope for sending.
+func textMessage(text string) *pb.ChatMessage {
+	return &pb.ChatMessage{ContentType: contentTypeText, Payload: &pb.ChatMessage_Text{Text: &pb.TextPayload{Text: text}}}
+}
+
+// envelopeFromRequest returns the message a client asked to send, taken from the deprecated message field if the
+// client doesn't know about envelopes yet. Only the content the client may set is kept.
+func envelopeFromRequest(request *pb.SendRequest) (*pb.ChatMessage, error) {
+	if request.ChatMessage == nil {
+		return textMessage(request.Message), nil
+	}
+	text, ok := request.ChatMessage.Payload.(*pb.ChatMessage_Text)
+	if !ok || text.Text == nil {
+		return nil, status.Error(codes.InvalidArgument, "only text messages can be sent")
+	}
+	contentType := request.ChatMessage.ContentType
+	switch contentType {
+	case "":
+		contentType = contentTypeText
+	case contentTypeText, contentTypeMarkdown:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported content type %q", contentType)
+	}
+	cm := &pb.ChatMessage{
+		ContentType: contentType,
+		ParentId:    request.ChatMessage.ParentId,
+		Payload:     &pb.ChatMessage_Text{Text: &pb.TextPayload{Text: text.Text.Text}},
+	}
+	for _, attachment := range request.ChatMessage.Attachments {
+		cm.Attachments = append(cm.Attachments, &pb.Attachment{Id: attachment.Id, Name: attachment.Name})
+	}
+	return cm, nil
+}
+
+// systemEvent returns an event from the server itself, it has no id and isn't stored.
+func systemEvent(room string, kind pb.SystemEvent_Kind, text string) *pb.ReceiveResponse {
+	msg := &pb.ReceiveResponse{
+		Room: room,
+		ChatMessage: &pb.ChatMessage{
+			Version:   envelopeVersion,
+			Room:      room,
+			Timestamp: timestamppb.Now(),
+			Payload:   &pb.ChatMessage_System{System: &pb.SystemEvent{Kind: kind, Text: text}},
+		},
+	}
+	normalize(msg)
+	return msg
+}
+
+// membershipEvent returns an event telling that a member joined or left a room, it has no id and isn't stored.
+func membershipEvent(room string, kind pb.MembershipEvent_Kind, user, displayName string) *pb.ReceiveResponse {
+	msg := &pb.ReceiveResponse{
+		Room: room,
+		ChatMessage: &pb.ChatMessage{
+			Version:   envelopeVersion,
+			Author:    user,
+			Room:      room,
+			Timestamp: timestamppb.Now(),
+			Payload:   &pb.ChatMessage_Membership{Membership: &pb.MembershipEvent{Kind: kind, User: user, DisplayName: displayName}},
+		},
+	}
+	normalize(msg)
+	return msg
+}
+
+// typingEvent returns an event telling that a member started or stopped typing, it has no id and isn't stored.
+func typingEvent(room string, member memberKey, typing bool) *pb.ReceiveResponse {
+	msg := &pb.ReceiveResponse{
+		Room: room,
+		ChatMessage: &pb.ChatMessage{
+			Version:   envelopeVersion,
+			Author:    member.user,
+			Room:      room,
+			Timestamp: timestamppb.Now(),
+			Payload:   &pb.ChatMessage_Typing{Typing: &pb.TypingEvent{User: member.user, DisplayName: member.displayName, Typing: typing}},
+		},
+	}
+	normalize(msg)
+	return msg
+}
+
+// heartbeatEvent returns an event showing that the stream is alive while its room is quiet, it has no id and isn't
+// stored.
+func heartbeatEvent(room string, interval time.Duration) *pb.ReceiveResponse {
+	now := timestamppb.Now()
+	msg := &pb.ReceiveResponse{
+		Room: room,
+		ChatMessage: &pb.ChatMessage{
+			Version:   envelopeVersion,
+			Room:      room,
+			Timestamp: now,
+			Payload:   &pb.ChatMessage_Heartbeat{Heartbeat: &pb.Heartbeat{Timestamp: now, Interval: durationpb.New(interval)}},
+		},
+	}
+	normalize(msg)
+	return msg
+}
+
+// attachmentName returns the file name of an attachment, or its shortened id if it has none.
+func attachmentName(attachment *pb.Attachment) string {
+	if attachment.Name != "" {
+		return attachment.Name
+	}
+	if len(attachment.Id) > 12 {
+		return attachment.Id[:12]
+	}
+	return attachment.Id
+}
+
+// memberName returns how a member is shown, its display name followed by the user name if they differ.
+func memberName(user, displayName string) string {
+	if displayName == "" || displayName == user {
+		return user
+	}
+	return fmt.Sprintf("%s (%s)", displayName, user)
+}
+
+// storedForm returns the copy of a message written to the log. Only the envelope is kept, without the id and room,
+// which are given by the position in the log of a room.
+func storedForm(msg *pb.ReceiveResponse) *pb.ReceiveResponse {
+	cm := proto.Clone(msg.ChatMessage).(*pb.ChatMessage)
+	cm.Id = 0
+	cm.Room = ""
+	return &pb.ReceiveResponse{IdempotencyKey: msg.IdempotencyKey, ChatMessage: cm}
+}
+
+// normalize fills both the envelope and the deprecated flat fields of a message, whichever of them it came with.
+// Messages stored before the envelope existed only have the flat fields, newer ones only the envelope.
+func normalize(msg *pb.ReceiveResponse) {
+	cm := msg.ChatMessage
+	if cm == nil {
+		cm = &pb.ChatMessage{Version: envelopeVersion, Author: msg.Author, Timestamp: msg.Timestamp}
+		if msg.System != nil {
+			cm.Payload = &pb.ChatMessage_System{System: msg.System}
+		} else {
+			cm.ContentType = contentTypeText
+			cm.Payload = &pb.ChatMessage_Text{Text: &pb.TextPayload{Text: msg.Message}}
+		}
+		msg.ChatMessage = cm
+	}
+	// direct messages are delivered to room streams without an id of the room, they keep the one of their conversation
+	if msg.Id != 0 {
+		cm.Id = msg.Id
+	}
+	if msg.Room != "" {
+		cm.Room = msg.Room
+	}
+
+	msg.Author = cm.Author
+	msg.Timestamp = cm.Timestamp
+	msg.System = cm.GetSystem()
+	msg.Message = describe(cm)
+}
+
+// describe returns the text of a text message and a short description of any other payload, for clients which can
+// only show text.
+func describe(cm *pb.ChatMessage) string {
+	if cm.Deleted {
+		return "message deleted"
+	}
+	switch p := cm.Payload.(type) {
+	case *pb.ChatMessage_Text:
+		if len(cm.Attachments) == 0 {
+			return p.Text.GetText()
+		}
+		names := make([]string, 0, len(cm.Attachments))
+		for _, attachment := range cm.Attachments {
+			names = append(names, fmt.Sprintf("%s (%s, %d bytes)", attachmentName(attachment), attachment.ContentType, attachment.Size))
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s [attached: %s]", p.Text.GetText(), strings.Join(names, ", ")))
+	case *pb.ChatMessage_System:
+		return p.System.GetText()
+	case *pb.ChatMessage_Membership:
+		name := memberName(p.Membership.GetUser(), p.Membership.GetDisplayName())
+		switch p.Membership.GetKind() {
+		case pb.MembershipEvent_KIND_JOIN:
+			return fmt.Sprintf("%s joined", name)
+		case pb.MembershipEvent_KIND_LEAVE:
+			return fmt.Sprintf("%s left", name)
+		}
+	case *pb.ChatMessage_Typing:
+		name := memberName(p.Typing.GetUser(), p.Typing.GetDisplayName())
+		if p.Typing.GetTyping() {
+			return fmt.Sprintf("%s is typing…", name)
+		}
+		return fmt.Sprintf("%s stopped typing", name)
+	case *pb.ChatMessage_Edit:
+		return fmt.Sprintf("edited message %d: %s", p.Edit.GetMessageId(), p.Edit.GetText())
+	case *pb.ChatMessage_Delete:
+		return fmt.Sprintf("deleted message %d", p.Delete.GetMessageId())
+	case *pb.ChatMessage_Reaction:
+		if p.Reaction.GetRemoved() {
+			return fmt.Sprintf("removed reaction %s from message %d", p.Reaction.GetEmoji(), p.Reaction.GetMessageId())
+		}
+		return fmt.Sprintf("reacted with %s to message %d", p.Reaction.GetEmoji(), p.Reaction.GetMessageId())
+	case *pb.ChatMessage_Heartbeat:
+		return "heartbeat"
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type ChatHistoryCmd struct {
+	serverConnection `embed:""`
+
+	Room   string `help:"room to show messages of" default:"general"`
+	With   string `help:"show the direct messages exchanged with this user instead of the messages of a room"`
+	Thread int32  `help:"show the thread of this message, its root and all replies, instead of paging through the messages"`
+	Author string `help:"only show messages of this user"`
+	Since  string `help:"only show messages sent at or after this time, either a date, an RFC 3339 time or a duration like 2h meaning that long ago"`
+	Until  string `help:"only show messages sent before this time, in the same formats as --since"`
+	Before int32  `help:"only show messages with an id lower than this one" xor:"cursor"`
+	After  int32  `help:"only show messages with an id higher than this one, shows the oldest messages first instead of the newest" xor:"cursor"`
+	Limit  int32  `help:"maximum number of messages to show" default:"50"`
+	All    bool   `help:"show all matching messages instead of a single page, --limit is the size of the pages fetched"`
+	Output string `short:"o" help:"output format: text or json, which prints one message per line" enum:"text,json" default:"text"`
+}
+
+func (h *ChatHistoryCmd) Run(cmdCtx *cmdContext) error {
+	now := time.Now()
+	request := &pb.HistoryRequest{Room: h.Room, Author: h.Author, Limit: h.Limit}
+	if h.With != "" {
+		request.Room = ""
+		request.Peer = h.With
+	}
+	if h.Since != "" {
+		since, err := parseTimeFlag(h.Since, now)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+		request.Since = timestamppb.New(since)
+	}
+	if h.Until != "" {
+		until, err := parseTimeFlag(h.Until, now)
+		if err != nil {
+			return fmt.Errorf("invalid --until: %w", err)
+		}
+		request.Until = timestamppb.New(until)
+	}
+	if h.Thread > 0 {
+		return h.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+			resp, err := pbClient.GetThread(ctx, &pb.GetThreadRequest{Room: request.Room, Peer: request.Peer, MessageId: h.Thread})
+			if err != nil {
+				return fmt.Errorf("failed to get thread: %w", err)
+			}
+			return printMessages(os.Stdout, append([]*pb.ChatMessage{resp.Root}, resp.Replies...), h.Output)
+		})
+	}
+	if h.After > 0 {
+		request.Cursor = h.After
+	} else {
+		// the newest messages are the interesting ones unless asked otherwise
+		request.Direction = pb.HistoryRequest_DIRECTION_BACKWARD
+		request.Cursor = h.Before
+	}
+
+	return h.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+		var pages [][]*pb.ChatMessage
+		for {
+			resp, err := pbClient.History(ctx, request)
+			if err != nil {
+				return fmt.Errorf("failed to get history: %w", err)
+			}
+			if request.Direction == pb.HistoryRequest_DIRECTION_FORWARD {
+				// forward pages come in the order they're printed in
+				if err := printMessages(os.Stdout, resp.Messages, h.Output); err != nil {
+					return err
+				}
+			} else {
+				pages = append(pages, resp.Messages)
+			}
+			if !h.All || resp.NextCursor == 0 {
+				break
+			}
+			request.Cursor = resp.NextCursor
+		}
+		for i := len(pages) - 1; i >= 0; i-- {
+			if err := printMessages(os.Stdout, pages[i], h.Output); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseTimeFlag accepts an RFC 3339 time, a local date with an optional time, or a duration which is subtracted from
+// now.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("expected a date, an RFC 3339 time or a duration")
+}
+
+// printMessages writes messages either as lines of text or as JSON lines.
+func printMessages(w io.Writer, messages []*pb.ChatMessage, output string) error {
+	for _, cm := range messages {
+		var err error
+		if output == "json" {
+			var data []byte
+			data, err = protojson.Marshal(cm)
+			if err != nil {
+				return fmt.Errorf("failed to marshal message %d: %w", cm.Id, err)
+			}
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		} else {
+			_, err = fmt.Fprintln(w, formatMessage(cm))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatMessage returns a message as a single line of text.
+func formatMessage(cm *pb.ChatMessage) string {
+	ts := cm.Timestamp.AsTime().Local().Format("2006-01-02 15:04:05")
+	text := describe(cm)
+	if cm.EditedAt != nil {
+		text += " (edited)"
+	}
+	if len(cm.Reactions) > 0 {
+		text += "  [" + formatReactions(cm.Reactions) + "]"
+	}
+	if cm.ReplyCount > 0 {
+		text += fmt.Sprintf("  (%d replies)", cm.ReplyCount)
+	}
+	if cm.ParentId != 0 {
+		text = fmt.Sprintf("↳ re [%d] %s", cm.ParentId, text)
+	}
+	if cm.Recipient != "" {
+		return fmt.Sprintf("%s [%d] %s → %s: %s", ts, cm.Id, cm.Author, cm.Recipient, text)
+	}
+	return fmt.Sprintf("%s [%d] %s: %s", ts, cm.Id, cm.Author, text)
+}
+
+// formatReactions returns a summary of the reactions to a message, every emoji with the number of users who used it.
+func formatReactions(reactions []*pb.Reaction) string {
+	if len(reactions) == 0 {
+		return "none"
+	}
+	parts := make([]string, 0, len(reactions))
+	for _, r := range reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", r.Emoji, len(r.Users)))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+
+	// maxPrefixExpansion limits how many words a prefix query like "a*" is expanded to
+	maxPrefixExpansion = 1000
+)
+
+// token is a word of a text, with its byte offsets in the original text.
+type token struct {
+	text       string
+	start, end int
+}
+
+// tokenize splits text into words, runs of letters and digits, folded to lower case.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			tokens = append(tokens, token{text: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{text: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// searchClause is a part of a query every result has to match: a single word, or a phrase of words following each
+// other. If prefix is set, the last word matches every word starting with it.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearchQuery parses a query of words, "quoted phrases" and words ending in * for prefix matching.
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		var part string
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				return nil, status.Error(codes.InvalidArgument, "unterminated quote in query")
+			}
+			part, query = query[1:end+1], query[end+2:]
+		} else {
+			end := strings.IndexFunc(query, unicode.IsSpace)
+			if end < 0 {
+				end = len(query)
+			}
+			part, query = query[:end], query[end:]
+		}
+		var clause searchClause
+		for _, t := range tokenize(part) {
+			clause.terms = append(clause.terms, t.text)
+		}
+		if len(clause.terms) == 0 {
+			continue
+		}
+		clause.prefix = strings.HasSuffix(part, "*")
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "query has no words to search for")
+	}
+	return clauses, nil
+}
+
+// matchesToken tells whether a token of a text is one of the words a query looks for, for highlighting.
+func matchesToken(clauses []searchClause, t string) bool {
+	for _, c := range clauses {
+		for i, term := range c.terms {
+			if t == term || (c.prefix && i == len(c.terms)-1 && strings.HasPrefix(t, term)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// highlights returns the byte ranges of the words of text a query looks for.
+func highlights(clauses []searchClause, text string) []*pb.TextRange {
+	var ranges []*pb.TextRange
+	for _, t := range tokenize(text) {
+		if matchesToken(clauses, t.text) {
+			ranges = append(ranges, &pb.TextRange{Start: int32(t.start), End: int32(t.end)})
+		}
+	}
+	return ranges
+}
+
+// searchIndex is an in-memory inverted index of the text messages of a room. It's rebuilt from the message log when
+// the server starts.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string][]posting
+	terms    []string // sorted, for prefix queries
+	docs     map[int32]docMeta
+}
+
+// posting lists the positions of a word within a message.
+type posting struct {
+	id        int32
+	positions []int32
+}
+
+type docMeta struct {
+	author string
+	at     time.Time
+	terms  []string // to find the postings of the message again when it's edited or deleted
+}
+
+// searchHit is a message matching a query.
+type searchHit struct {
+	id int32
+	at time.Time
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: map[string][]posting{}, docs: map[int32]docMeta{}}
+}
+
+// add indexes a stored message.
+func (ix *searchIndex) add(cm *pb.ChatMessage) {
+	text := cm.GetText().GetText()
+	if text == "" {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.addText(cm.Id, docMeta{author: cm.Author, at: cm.Timestamp.AsTime()}, text)
+}
+
+// update replaces the indexed text of an edited message.
+func (ix *searchIndex) update(id int32, text string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	meta, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	ix.removeDoc(id)
+	ix.addText(id, meta, text)
+}
+
+// remove drops a deleted message from the index.
+func (ix *searchIndex) remove(id int32) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.removeDoc(id)
+}
+
+func (ix *searchIndex) addText(id int32, meta docMeta, text string) {
+	positions := map[string][]int32{}
+	var order []string
+	for i, t := range tokenize(text) {
+		if _, ok := positions[t.text]; !ok {
+			order = append(order, t.text)
+		}
+		positions[t.text] = append(positions[t.text], int32(i))
+	}
+	meta.terms = order
+	ix.docs[id] = meta
+	for _, term := range order {
+		if _, ok := ix.postings[term]; !ok {
+			i := sort.SearchStrings(ix.terms, term)
+			ix.terms = append(ix.terms, "")
+			copy(ix.terms[i+1:], ix.terms[i:])
+			ix.terms[i] = term
+		}
+		ix.postings[term] = append(ix.postings[term], posting{id: id, positions: positions[term]})
+	}
+}
+
+func (ix *searchIndex) removeDoc(id int32) {
+	meta, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	delete(ix.docs, id)
+	for _, term := range meta.terms {
+		postings := ix.postings[term]
+		for i, p := range postings {
+			if p.id == id {
+				postings = append(postings[:i], postings[i+1:]...)
+				break
+			}
+		}
+		if len(postings) > 0 {
+			ix.postings[term] = postings
+			continue
+		}
+		delete(ix.postings, term)
+		i := sort.SearchStrings(ix.terms, term)
+		ix.terms = append(ix.terms[:i], ix.terms[i+1:]...)
+	}
+}
+
+// search returns the messages matching all clauses and the filters, in id order.
+func (ix *searchIndex) search(clauses []searchClause, author string, since, until time.Time) []searchHit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var ids []int32
+	for i, c := range clauses {
+		matched := ix.matchClause(c)
+		if i == 0 {
+			ids = matched
+		} else {
+			ids = intersect(ids, matched)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+
+	var hits []searchHit
+	for _, id := range ids {
+		meta := ix.docs[id]
+		if author != "" && meta.author != author {
+			continue
+		}
+		if !since.IsZero() && meta.at.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !meta.at.Before(until) {
+			continue
+		}
+		hits = append(hits, searchHit{id: id, at: meta.at})
+	}
+	return hits
+}
+
+// lookup returns the positions of a word, or of all words starting with it, in every message containing it.
+func (ix *searchIndex) lookup(term string, prefix bool) map[int32][]int32 {
+	found := map[int32][]int32{}
+	if !prefix {
+		for _, p := range ix.postings[term] {
+			found[p.id] = p.positions
+		}
+		return found
+	}
+	i := sort.SearchStrings(ix.terms, term)
+	for n := 0; i < len(ix.terms) && strings.HasPrefix(ix.terms[i], term) && n < maxPrefixExpansion; i, n = i+1, n+1 {
+		for _, p := range ix.postings[ix.terms[i]] {
+			found[p.id] = append(found[p.id], p.positions...)
+		}
+	}
+	return found
+}
+
+func (ix *searchIndex) matchClause(c searchClause) []int32 {
+	words := make([]map[int32][]int32, len(c.terms))
+	for i, term := range c.terms {
+		words[i] = ix.lookup(term, c.prefix && i == len(c.terms)-1)
+	}
+
+	var ids []int32
+	for id, positions := range words[0] {
+		if containsPhrase(words, id, positions) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// containsPhrase tells whether a message has the words of a phrase following each other, starting at one of the
+// positions of its first word.
+func containsPhrase(words []map[int32][]int32, id int32, positions []int32) bool {
+	for _, start := range positions {
+		ok := true
+		for i := 1; i < len(words) && ok; i++ {
+			ok = containsPosition(words[i][id], start+int32(i))
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPosition(positions []int32, position int32) bool {
+	for _, p := range positions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the ids in both sorted lists.
+func intersect(a, b []int32) []int32 {
+	var out []int32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
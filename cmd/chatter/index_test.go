@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var indexEpoch = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestIndex() *searchIndex {
+	ix := newSearchIndex()
+	for i, m := range []struct {
+		author, text string
+	}{
+		{"alice", "Hello world"},
+		{"bob", "the quick brown fox"},
+		{"alice", "brown bread and quick coffee"},
+		{"carol", "World peace, hello again!"},
+		{"bob", "Quickly now"},
+	} {
+		cm := textMessage(m.text)
+		cm.Id = int32(i + 1)
+		cm.Author = m.author
+		cm.Timestamp = timestamppb.New(indexEpoch.Add(time.Duration(i) * time.Hour))
+		ix.add(cm)
+	}
+	return ix
+}
+
+func searchIds(t *testing.T, ix *searchIndex, query, author string, since, until time.Time) []int32 {
+	t.Helper()
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", query, err)
+	}
+	var ids []int32
+	for _, hit := range ix.search(clauses, author, since, until) {
+		ids = append(ids, hit.id)
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	ix := newTestIndex()
+	for _, tc := range []struct {
+		query string
+		want  []int32
+	}{
+		{query: "hello", want: []int32{1, 4}},
+		{query: "HELLO", want: []int32{1, 4}},
+		{query: "hello world", want: []int32{1, 4}},
+		{query: "brown quick", want: []int32{2, 3}},
+		{query: `"quick brown"`, want: []int32{2}},
+		{query: `"brown quick"`},
+		{query: `"world peace" hello`, want: []int32{4}},
+		{query: "quick*", want: []int32{2, 3, 5}},
+		{query: `"the qu*"`, want: []int32{2}},
+		{query: "missing"},
+		{query: "hello missing"},
+	} {
+		if got := searchIds(t, ix, tc.query, "", time.Time{}, time.Time{}); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestSearchIndexFilters(t *testing.T) {
+	ix := newTestIndex()
+	if got := searchIds(t, ix, "quick*", "bob", time.Time{}, time.Time{}); !reflect.DeepEqual(got, []int32{2, 5}) {
+		t.Errorf("by author: got %v", got)
+	}
+	// since is inclusive, until exclusive
+	since, until := indexEpoch.Add(time.Hour), indexEpoch.Add(4*time.Hour)
+	if got := searchIds(t, ix, "quick*", "", since, until); !reflect.DeepEqual(got, []int32{2, 3}) {
+		t.Errorf("by time: got %v", got)
+	}
+}
+
+func TestSearchIndexEditsAndDeletes(t *testing.T) {
+	ix := newTestIndex()
+	ix.update(2, "the slow green turtle")
+	if got := searchIds(t, ix, "fox", "", time.Time{}, time.Time{}); got != nil {
+		t.Errorf("old text of an edited message still matches: %v", got)
+	}
+	if got := searchIds(t, ix, "turtle", "", time.Time{}, time.Time{}); !reflect.DeepEqual(got, []int32{2}) {
+		t.Errorf("new text of an edited message: got %v", got)
+	}
+	// the author and time stay those of the original message
+	if got := searchIds(t, ix, "turtle", "bob", indexEpoch.Add(time.Hour), time.Time{}); !reflect.DeepEqual(got, []int32{2}) {
+		t.Errorf("edited message lost its author or time: got %v", got)
+	}
+
+	ix.remove(1)
+	if got := searchIds(t, ix, "hello", "", time.Time{}, time.Time{}); !reflect.DeepEqual(got, []int32{4}) {
+		t.Errorf("deleted message still matches: %v", got)
+	}
+	ix.remove(4)
+	if got := searchIds(t, ix, "hel*", "", time.Time{}, time.Time{}); got != nil {
+		t.Errorf("words of deleted messages are still expanded: %v", got)
+	}
+	if len(ix.postings["hello"]) != 0 {
+		t.Errorf("postings of a word no message has any more are kept: %v", ix.postings["hello"])
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	clauses, err := parseSearchQuery(`  Hello "Big World" ca* `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []searchClause{{terms: []string{"hello"}}, {terms: []string{"big", "world"}}, {terms: []string{"ca"}, prefix: true}}
+	if !reflect.DeepEqual(clauses, want) {
+		t.Fatalf("got %+v, want %+v", clauses, want)
+	}
+	for _, query := range []string{"", "  ", `"unterminated`, "*", `"" ?!`} {
+		if _, err := parseSearchQuery(query); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+}
+
+func TestHighlights(t *testing.T) {
+	clauses, _ := parseSearchQuery("hel* world")
+	got := highlights(clauses, "Hello, World! Help the worlds.")
+	want := []*pb.TextRange{{Start: 0, End: 5}, {Start: 7, End: 12}, {Start: 14, End: 18}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Start != want[i].Start || got[i].End != want[i].End {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// missedHeartbeats is how many heartbeat intervals a stream may go without anything being sent to it, or a Chat
+// stream without hearing from its client, before it's considered dead.
+const missedHeartbeats = 3
+
+// serverKeepaliveOptions are the cli options controlling how the server finds out about dead connections. Pings find
+// connections whose peer is gone without closing them, heartbeats find streams which stopped moving.
+type serverKeepaliveOptions struct {
+	KeepaliveTime                time.Duration `help:"how long a connection may be idle before the server pings the client to check it's still there" default:"1m"`
+	KeepaliveTimeout             time.Duration `help:"how long the server waits for the answer to a ping before closing the connection" default:"20s"`
+	KeepaliveMinTime             time.Duration `help:"minimum time between pings from clients, connections of clients pinging more often are closed" default:"10s"`
+	KeepalivePermitWithoutStream bool          `help:"allow clients to ping while they have no calls in progress"`
+	HeartbeatInterval            time.Duration `help:"how often heartbeats are sent on Chat streams and Receive streams asking for them, streams which miss three are closed, 0 disables heartbeats" default:"15s"`
+}
+
+func (o serverKeepaliveOptions) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.KeepaliveTime, Timeout: o.KeepaliveTimeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: o.KeepaliveMinTime, PermitWithoutStream: o.KeepalivePermitWithoutStream}),
+	}
+}
+
+// reap disconnects the subscribers whose streams missed their heartbeats, because the client stopped reading or the
+// connection is half-open. Their streams stay until the transport gives up on them, but they're taken out of their
+// rooms right away, so nothing piles up for them in the meantime. It returns how many were reaped.
+func (s *ChatServerCmd) reap(now time.Time) int {
+	limit := missedHeartbeats * s.HeartbeatInterval
+	reaped := 0
+	for _, rm := range s.rooms.List() {
+		rm.subscribers.Range(func(key, value interface{}) bool {
+			if s.reapSubscriber(rm, key, value.(*subscriber), now, limit) {
+				reaped++
+			}
+			return true
+		})
+	}
+	return reaped
+}
+
+// reapSubscriber disconnects a subscriber of a room if it missed its heartbeats. It's only taken out of the room if
+// it's still stored under key, a session which replaced it in the meantime stays. It returns whether it was taken out.
+func (s *ChatServerCmd) reapSubscriber(rm *room, key interface{}, sub *subscriber, now time.Time, limit time.Duration) bool {
+	if !sub.missedHeartbeats(now, limit) {
+		return false
+	}
+	sub.finish(status.Error(codes.Unavailable, "missed heartbeats"))
+	if !rm.subscribers.CompareAndDelete(key, sub) {
+		return false
+	}
+	s.logger.Warn("reaped subscriber", "clientId", sub.clientId, "sessionId", sub.sessionId, "room", rm.name, "user", sub.member.user, "silence", now.Sub(time.Unix(0, sub.lastSent.Load())).Round(time.Second))
+	s.metrics.subscribersReaped.WithLabelValues(rm.name).Inc()
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestSubscriber returns a subscriber of alice which last got something sent silence before now.
+func newTestSubscriber(t *testing.T, heartbeats bool, now time.Time, silence time.Duration) *subscriber {
+	t.Helper()
+	sub, err := newSubscriber("client", memberKey{user: "alice"}, 10, overflowDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.heartbeats = heartbeats
+	sub.lastSent.Store(now.Add(-silence).UnixNano())
+	return sub
+}
+
+func TestReap(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.HeartbeatInterval = time.Second
+	t.Cleanup(func() { s.rooms.Close() })
+	rm, err := s.rooms.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limit := missedHeartbeats * s.HeartbeatInterval
+
+	stuck := newTestSubscriber(t, true, now, limit+time.Millisecond)
+	quiet := newTestSubscriber(t, true, now, limit)
+	// without heartbeats silence only means the room is quiet
+	silent := newTestSubscriber(t, false, now, time.Hour)
+	for _, sub := range []*subscriber{stuck, quiet, silent} {
+		rm.subscribers.Store(sub.sessionId, sub)
+	}
+
+	if reaped := s.reap(now); reaped != 1 {
+		t.Fatalf("reaped %d subscribers, want 1", reaped)
+	}
+	if _, ok := rm.subscribers.Load(stuck.sessionId); ok {
+		t.Fatal("reaped subscriber is still in its room")
+	}
+	if !finished(stuck) || status.Code(stuck.err) != codes.Unavailable {
+		t.Fatalf("reaped subscriber finished %v with %v, want Unavailable", finished(stuck), stuck.err)
+	}
+	for _, sub := range []*subscriber{quiet, silent} {
+		if _, ok := rm.subscribers.Load(sub.sessionId); !ok || finished(sub) {
+			t.Fatalf("subscriber with heartbeats %v was reaped", sub.heartbeats)
+		}
+	}
+	if reaped := s.reap(now); reaped != 0 {
+		t.Fatalf("reaped %d subscribers again", reaped)
+	}
+}
+
+func TestReapKeepsReplacingSession(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.HeartbeatInterval = time.Second
+	t.Cleanup(func() { s.rooms.Close() })
+	rm, err := s.rooms.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limit := missedHeartbeats * s.HeartbeatInterval
+
+	// reap found the stuck subscriber, but by the time it's taken out another session took its place
+	stuck := newTestSubscriber(t, true, now, 2*limit)
+	replacement := newTestSubscriber(t, true, now, 0)
+	rm.subscribers.Store("session", replacement)
+
+	if s.reapSubscriber(rm, "session", stuck, now, limit) {
+		t.Fatal("stuck subscriber was taken out in place of the session which replaced it")
+	}
+	if !finished(stuck) || status.Code(stuck.err) != codes.Unavailable {
+		t.Fatalf("stuck subscriber finished %v with %v, want Unavailable", finished(stuck), stuck.err)
+	}
+	if value, ok := rm.subscribers.Load("session"); !ok || value.(*subscriber) != replacement || finished(replacement) {
+		t.Fatal("the replacing session was removed")
+	}
+}
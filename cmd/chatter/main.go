@@ -17,9 +17,14 @@ type cmdContext struct {
 var kongApp struct {
 	LogLevel int `short:"l" help:"Log level: 0 (debug), 1 (info), 2 (warn), 3 (error)" default:"1"`
 
-	ChatServer ChatServerCmd `cmd:"" help:"Start a chat server."`
-	Client     ChatClientCmd `cmd:"" help:"Start a chat client."`
-	Board      ChatBoardCmd  `cmd:"" help:"Start a chat board."`
+	ChatServer ChatServerCmd  `cmd:"" help:"Start a chat server."`
+	Client     ChatClientCmd  `cmd:"" help:"Start a chat client."`
+	Board      ChatBoardCmd   `cmd:"" help:"Start a chat board."`
+	Rooms      ChatRoomsCmd   `cmd:"" help:"Manage chat rooms."`
+	History    ChatHistoryCmd `cmd:"" help:"Show past messages of a room."`
+	Search     ChatSearchCmd  `cmd:"" help:"Search past messages."`
+	Certs      ChatCertsCmd   `cmd:"" help:"Generate a self-signed CA and certificates for local testing."`
+	Passwd     ChatPasswdCmd  `cmd:"" help:"Set the password of a user in the server's users file."`
 }
 
 func main() {
@@ -31,7 +36,8 @@ func main() {
 		kong.UsageOnError(),
 		kong.Vars{
 
-			"version": "0.0.1", // TODO: Use goreleaser to set this?
+			"version":   "0.0.1", // TODO: Use goreleaser to set this?
+			"state_dir": defaultStateDir(),
 		},
 	)
 	switch kongApp.LogLevel {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// serverMetrics are the prometheus metrics of the chat server, exposed on --metrics-addr.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	messagesReceived  *prometheus.CounterVec
+	messagesBroadcast *prometheus.CounterVec
+	messagesDropped   *prometheus.CounterVec
+	sendFailures      *prometheus.CounterVec
+	subscribersReaped *prometheus.CounterVec
+	grpcRequests      *prometheus.CounterVec
+	grpcDuration      *prometheus.HistogramVec
+}
+
+func newServerMetrics(s *ChatServerCmd) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_messages_received_total",
+			Help: "Messages stored after being sent to the server, duplicates excluded.",
+		}, []string{"room"}),
+		messagesBroadcast: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_messages_broadcast_total",
+			Help: "Messages fanned out to the subscribers of their room by the broadcast goroutine.",
+		}, []string{"room"}),
+		messagesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_messages_dropped_total",
+			Help: "Messages not queued for a subscriber because its queue was full.",
+		}, []string{"room", "policy"}),
+		sendFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_send_failures_total",
+			Help: "Messages which failed to be stored or delivered, by where it happened: append or stream.",
+		}, []string{"stage"}),
+		subscribersReaped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_subscribers_reaped_total",
+			Help: "Subscribers disconnected because their streams missed heartbeats.",
+		}, []string{"room"}),
+		grpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chatter_grpc_requests_total",
+			Help: "Finished gRPC calls by method and status code.",
+		}, []string{"method", "code"}),
+		grpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chatter_grpc_request_duration_seconds",
+			Help:    "Latency of unary gRPC calls by method.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"method"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.messagesReceived,
+		m.messagesBroadcast,
+		m.messagesDropped,
+		m.sendFailures,
+		m.subscribersReaped,
+		m.grpcRequests,
+		m.grpcDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chatter_broadcast_queue_length",
+			Help: "Messages waiting in the channel of the broadcast goroutine, staying at capacity means it's stuck.",
+		}, func() float64 { return float64(len(s.messagesChannel)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chatter_broadcast_queue_capacity",
+			Help: "Size of the channel of the broadcast goroutine.",
+		}, func() float64 { return float64(cap(s.messagesChannel)) }),
+		&roomCollector{rooms: func() []*room { return s.rooms.List() }},
+	)
+	return m
+}
+
+func (m *serverMetrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	m.grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func (m *serverMetrics) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// streams live as long as the client stays, so only their outcome is counted
+	err := handler(srv, ss)
+	m.grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return err
+}
+
+var (
+	subscribersDesc = prometheus.NewDesc("chatter_subscribers", "Clients currently receiving the messages of a room.", []string{"room"}, nil)
+	lastIdDesc      = prometheus.NewDesc("chatter_room_last_id", "Id of the newest message of a room.", []string{"room"}, nil)
+	queueDepthDesc  = prometheus.NewDesc("chatter_subscriber_queue_depth", "Messages queued for a subscriber and not yet sent to it.", []string{"room", "client_id", "session_id"}, nil)
+)
+
+// roomCollector reports the state of the rooms and their subscribers at scrape time, so nothing has to be kept in sync
+// as rooms and subscribers come and go.
+type roomCollector struct {
+	rooms func() []*room
+}
+
+func (c *roomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subscribersDesc
+	ch <- lastIdDesc
+	ch <- queueDepthDesc
+}
+
+func (c *roomCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, rm := range c.rooms() {
+		subscribers := 0
+		rm.subscribers.Range(func(key, value interface{}) bool {
+			if sub, ok := value.(*subscriber); ok {
+				subscribers++
+				ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(len(sub.queue)), rm.name, sub.clientId, sub.sessionId)
+			}
+			return true
+		})
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(subscribers), rm.name)
+		ch <- prometheus.MustNewConstMetric(lastIdDesc, prometheus.GaugeValue, float64(rm.log.LastIndex()), rm.name)
+	}
+}
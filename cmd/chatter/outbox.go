@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"github.com/oklog/ulid"
+)
+
+// outboxEntry is a message waiting to be delivered to the server.
+type outboxEntry struct {
+	IdempotencyKey string             `json:"idempotencyKey"`
+	Room           string             `json:"room"`
+	Recipient      string             `json:"recipient,omitempty"`
+	ParentId       int32              `json:"parentId,omitempty"`
+	Attachments    []outboxAttachment `json:"attachments,omitempty"`
+	Message        string             `json:"message"`
+	QueuedAt       time.Time          `json:"queuedAt"`
+}
+
+// request returns the request sending the entry.
+func (e outboxEntry) request() *pb.SendRequest {
+	cm := textMessage(e.Message)
+	cm.ParentId = e.ParentId
+	for _, attachment := range e.Attachments {
+		cm.Attachments = append(cm.Attachments, &pb.Attachment{Id: attachment.Id, Name: attachment.Name})
+	}
+	return &pb.SendRequest{ChatMessage: cm, Room: e.Room, Recipient: e.Recipient, IdempotencyKey: e.IdempotencyKey}
+}
+
+// outboxAttachment refers to an attachment uploaded before the message was queued.
+type outboxAttachment struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// outbox is a durable queue of outgoing messages. Every message is written to disk before it's sent and removed once
+// the server acknowledged it, so nothing typed while disconnected is lost, even if the client is restarted. Messages
+// carry an idempotency key, which makes resending a message the server already got harmless.
+type outbox struct {
+	path string
+
+	mu      sync.Mutex
+	entries []outboxEntry
+	added   chan struct{}
+}
+
+func openOutbox(path string) (*outbox, error) {
+	o := &outbox{path: path, added: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if err := json.Unmarshal(data, &o.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox %s: %w", path, err)
+	}
+	if len(o.entries) > 0 {
+		o.added <- struct{}{}
+	}
+	return o, nil
+}
+
+// Add queues a message for sending, either to a room or, if the recipient is set, directly to a user. The entry gets
+// its idempotency key and time here.
+func (o *outbox) Add(entry outboxEntry) (outboxEntry, error) {
+	key, err := ulid.New(ulid.Now(), rand.Reader)
+	if err != nil {
+		return outboxEntry{}, fmt.Errorf("failed to create an idempotency key: %w", err)
+	}
+	entry.IdempotencyKey = key.String()
+	entry.QueuedAt = time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(o.entries, entry)
+	if err := o.save(); err != nil {
+		o.entries = o.entries[:len(o.entries)-1]
+		return outboxEntry{}, err
+	}
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+	return entry, nil
+}
+
+// Len returns the number of messages waiting to be sent.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+func (o *outbox) peek() (outboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 {
+		return outboxEntry{}, false
+	}
+	return o.entries[0], true
+}
+
+func (o *outbox) remove(key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.entries {
+		if e.IdempotencyKey == key {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return o.save()
+		}
+	}
+	return nil
+}
+
+func (o *outbox) save() error {
+	data, err := json.Marshal(o.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox: %w", err)
+	}
+	if err := writeFileAtomic(o.path, data); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return nil
+}
+
+// Flush sends queued messages in order until ctx is done. While the server is unreachable the oldest message is
+// retried with backoff delays and nothing behind it is sent. Messages rejected for good, e.g. because their room was
+// deleted, are dropped and passed to onError.
+func (o *outbox) Flush(ctx context.Context, pbClient pb.ChatServerClient, options reconnectOptions, onSent func(outboxEntry, *pb.SendResponse), onRetry func(err error, retryIn time.Duration), onError func(outboxEntry, error)) {
+	for {
+		entry, ok := o.peek()
+		if !ok {
+			select {
+			case <-o.added:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		resp, err := send(ctx, pbClient, entry.request(), options, onRetry)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			onError(entry, err)
+		} else {
+			onSent(entry, resp)
+		}
+		if err := o.remove(entry.IdempotencyKey); err != nil {
+			onError(entry, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeSendClient answers Send with the errors queued in errs before succeeding, and records the idempotency keys of
+// all attempts.
+type fakeSendClient struct {
+	pb.ChatServerClient
+
+	mu     sync.Mutex
+	errs   []error
+	keys   []string
+	nextId int32
+}
+
+func (c *fakeSendClient) Send(ctx context.Context, request *pb.SendRequest, _ ...grpc.CallOption) (*pb.SendResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = append(c.keys, request.IdempotencyKey)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	c.nextId++
+	return &pb.SendResponse{Id: c.nextId}, nil
+}
+
+func (c *fakeSendClient) sentKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.keys...)
+}
+
+func TestOutboxKeepsKeysAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	ob, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ob.Add(outboxEntry{Room: "general", Message: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ob.Add(outboxEntry{Room: "general", Message: "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.IdempotencyKey == "" || first.IdempotencyKey == second.IdempotencyKey {
+		t.Fatalf("entries got keys %q and %q, want distinct ones", first.IdempotencyKey, second.IdempotencyKey)
+	}
+
+	reopened, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 2 {
+		t.Fatalf("reopened outbox has %d entries, want 2", reopened.Len())
+	}
+	entry, _ := reopened.peek()
+	if entry.IdempotencyKey != first.IdempotencyKey || entry.Message != "one" {
+		t.Fatalf("first entry after reopening is %+v, want %+v", entry, first)
+	}
+	if request := entry.request(); request.IdempotencyKey != first.IdempotencyKey {
+		t.Fatalf("request carries key %q, want %q", request.IdempotencyKey, first.IdempotencyKey)
+	}
+}
+
+func TestOutboxFlushRetriesWithTheSameKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	ob, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ob.Add(outboxEntry{Room: "general", Message: "one"})
+	second, _ := ob.Add(outboxEntry{Room: "general", Message: "two"})
+	third, _ := ob.Add(outboxEntry{Room: "gone", Message: "three"})
+
+	// the first entry fails twice and then goes through, the third is rejected for good
+	client := &fakeSendClient{errs: []error{
+		status.Error(codes.Unavailable, "connection refused"),
+		status.Error(codes.DeadlineExceeded, "ack lost"),
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan outboxEntry, 3)
+	failed := make(chan outboxEntry, 3)
+	go ob.Flush(ctx, client, reconnectOptions{ReconnectMin: time.Millisecond, ReconnectMax: time.Millisecond},
+		func(entry outboxEntry, _ *pb.SendResponse) {
+			if entry.IdempotencyKey == second.IdempotencyKey {
+				client.mu.Lock()
+				client.errs = append(client.errs, status.Error(codes.NotFound, "room does not exist"))
+				client.mu.Unlock()
+			}
+			sent <- entry
+		},
+		func(error, time.Duration) {},
+		func(entry outboxEntry, err error) { failed <- entry },
+	)
+
+	for _, want := range []outboxEntry{first, second} {
+		select {
+		case entry := <-sent:
+			if entry.IdempotencyKey != want.IdempotencyKey {
+				t.Fatalf("sent %q, want %q", entry.Message, want.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q wasn't sent", want.Message)
+		}
+	}
+	select {
+	case entry := <-failed:
+		if entry.IdempotencyKey != third.IdempotencyKey {
+			t.Fatalf("%q failed, want %q", entry.Message, third.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rejected entry wasn't reported")
+	}
+
+	want := []string{first.IdempotencyKey, first.IdempotencyKey, first.IdempotencyKey, second.IdempotencyKey, third.IdempotencyKey}
+	keys := client.sentKeys()
+	if len(keys) != len(want) {
+		t.Fatalf("sent keys %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("sent keys %v, want %v", keys, want)
+		}
+	}
+
+	// every entry was removed, on disk too
+	reopened, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 0 {
+		t.Fatalf("outbox still has %d entries", reopened.Len())
+	}
+}
+
+func TestRoomRecognizesRetriedMessages(t *testing.T) {
+	dir := t.TempDir()
+	options := roomOptions{segmentSize: 1 << 20, syncMode: walSyncNever, syncInterval: time.Second, dedupWindow: time.Hour}
+	rm, err := openRoom(dir, "general", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan broadcast, 10)
+	newMessage := func(key, text string) *pb.ReceiveResponse {
+		cm := textMessage(text)
+		cm.Timestamp = timestamppb.Now()
+		return &pb.ReceiveResponse{ChatMessage: cm, IdempotencyKey: key}
+	}
+
+	first := newMessage("key-1", "one")
+	if duplicate, err := rm.append(first, messages); err != nil || duplicate {
+		t.Fatalf("first append gave %v, %v", duplicate, err)
+	}
+	if _, err := rm.append(newMessage("key-2", "two"), messages); err != nil {
+		t.Fatal(err)
+	}
+	retry := newMessage("key-1", "one")
+	if duplicate, err := rm.append(retry, messages); err != nil || !duplicate || retry.Id != first.Id {
+		t.Fatalf("retry gave duplicate %v, id %d, %v, want the id %d of the first attempt", duplicate, retry.Id, err, first.Id)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("%d messages were broadcast, want 2", len(messages))
+	}
+	if err := rm.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys of stored messages are remembered across restarts
+	rm, err = openRoom(dir, "general", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.log.Close()
+	retry = newMessage("key-1", "one")
+	if duplicate, err := rm.append(retry, messages); err != nil || !duplicate || retry.Id != first.Id {
+		t.Fatalf("retry after restart gave duplicate %v, id %d, %v, want the id %d of the first attempt", duplicate, retry.Id, err, first.Id)
+	}
+	if last := rm.log.LastIndex(); last != 2 {
+		t.Fatalf("log has %d messages, want 2", last)
+	}
+}
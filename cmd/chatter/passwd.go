@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slog"
+	"golang.org/x/term"
+)
+
+type ChatPasswdCmd struct {
+	// cli options
+	UsersFile string `help:"users file to update, created if missing" default:"users" type:"path"`
+	Delete    bool   `help:"remove the user instead of setting a password"`
+	User      string `arg:"" help:"name of the user"`
+
+	// Dependencies
+	logger *slog.Logger
+}
+
+// Run sets the password of a user in the users file read by the server. The password is read from the first line of
+// stdin, so it doesn't end up in the shell history, without echoing it when stdin is a terminal.
+func (p *ChatPasswdCmd) Run(cmdCtx *cmdContext) error {
+	p.logger = cmdCtx.Logger.With("component", "ChatPasswdCmd")
+	if p.User == "" || strings.ContainsAny(p.User, ": \t") {
+		return fmt.Errorf("invalid user name %q", p.User)
+	}
+
+	users := map[string][]byte{}
+	if _, err := os.Stat(p.UsersFile); err == nil {
+		users, err = readUsers(p.UsersFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Delete {
+		if _, ok := users[p.User]; !ok {
+			return fmt.Errorf("user %s does not exist", p.User)
+		}
+		delete(users, p.User)
+	} else {
+		fmt.Fprintf(os.Stderr, "password for %s: ", p.User)
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("empty password")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		users[p.User] = hash
+	}
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s:%s\n", name, users[name])
+	}
+	if err := writeFileAtomic(p.UsersFile, []byte(b.String())); err != nil {
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	if err := os.Chmod(p.UsersFile, 0o600); err != nil {
+		return fmt.Errorf("failed to restrict users file permissions: %w", err)
+	}
+	p.logger.Info("updated users file", "file", p.UsersFile, "user", p.User, "deleted", p.Delete)
+	return nil
+}
+
+// readPassword reads a line from stdin, turning off echo if it's a terminal.
+func readPassword() (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		// the newline typed after the password wasn't echoed either
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return string(password), nil
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return "", errors.New("no password given")
+	}
+	return scanner.Text(), nil
+}
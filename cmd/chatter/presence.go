@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// presence tracks who is receiving the messages of a room. A member is a user under a display name, so anonymous
+// users can tell each other apart, and stays present for as long as at least one of its streams is open.
+type presence struct {
+	mu      sync.Mutex
+	members map[memberKey]*member
+}
+
+type memberKey struct {
+	user, displayName string
+}
+
+type member struct {
+	connectedAt time.Time
+	activeAt    time.Time
+	streams     int
+}
+
+func newPresence() *presence {
+	return &presence{members: map[memberKey]*member{}}
+}
+
+// join registers a stream of a member and tells whether it's the member's first.
+func (p *presence) join(user, displayName string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := memberKey{user: user, displayName: displayName}
+	m, ok := p.members[key]
+	if !ok {
+		m = &member{connectedAt: now, activeAt: now}
+		p.members[key] = m
+	}
+	m.streams++
+	return !ok
+}
+
+// leave unregisters a stream of a member and tells whether it was the member's last.
+func (p *presence) leave(user, displayName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := memberKey{user: user, displayName: displayName}
+	m, ok := p.members[key]
+	if !ok {
+		return false
+	}
+	m.streams--
+	if m.streams > 0 {
+		return false
+	}
+	delete(p.members, key)
+	return true
+}
+
+// active records that a user sent a message, under whichever display names it's present.
+func (p *presence) active(user string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, m := range p.members {
+		if key.user == user {
+			m.activeAt = now
+		}
+	}
+}
+
+func (p *presence) list(now time.Time) []*pb.Member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members := make([]*pb.Member, 0, len(p.members))
+	for key, m := range p.members {
+		members = append(members, &pb.Member{
+			User:        key.user,
+			DisplayName: key.displayName,
+			ConnectedAt: timestamppb.New(m.connectedAt),
+			Idle:        durationpb.New(now.Sub(m.activeAt)),
+			Streams:     int32(m.streams),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].User != members[j].User {
+			return members[i].User < members[j].User
+		}
+		return members[i].DisplayName < members[j].DisplayName
+	})
+	return members
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxEmojiLength limits the size of a reaction, which is meant to be a single emoji or a shortcode
+const maxEmojiLength = 64
+
+// messageReactions aggregates the reactions to the messages of a room from the reaction events in its log.
+type messageReactions struct {
+	mu       sync.RWMutex
+	messages map[int32][]*pb.Reaction // in the order the emojis were first used
+}
+
+func newMessageReactions() *messageReactions {
+	return &messageReactions{messages: map[int32][]*pb.Reaction{}}
+}
+
+// has tells whether a user reacted to a message with an emoji.
+func (r *messageReactions) has(id int32, emoji, user string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, reaction := range r.messages[id] {
+		if reaction.Emoji == emoji {
+			return indexOf(reaction.Users, user) >= 0
+		}
+	}
+	return false
+}
+
+// record adds or removes a reaction of a user.
+func (r *messageReactions) record(id int32, emoji, user string, removed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reactions := r.messages[id]
+	i := 0
+	for ; i < len(reactions) && reactions[i].Emoji != emoji; i++ {
+	}
+	if removed {
+		if i == len(reactions) {
+			return
+		}
+		if j := indexOf(reactions[i].Users, user); j >= 0 {
+			reactions[i].Users = append(reactions[i].Users[:j], reactions[i].Users[j+1:]...)
+		}
+		if len(reactions[i].Users) == 0 {
+			reactions = append(reactions[:i], reactions[i+1:]...)
+		}
+	} else {
+		if i == len(reactions) {
+			reactions = append(reactions, &pb.Reaction{Emoji: emoji})
+		}
+		if indexOf(reactions[i].Users, user) < 0 {
+			reactions[i].Users = append(reactions[i].Users, user)
+		}
+	}
+	if len(reactions) == 0 {
+		delete(r.messages, id)
+		return
+	}
+	r.messages[id] = reactions
+}
+
+// clear forgets the reactions to a deleted message.
+func (r *messageReactions) clear(id int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.messages, id)
+}
+
+// get returns a copy of the reactions to a message.
+func (r *messageReactions) get(id int32) []*pb.Reaction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reactions := r.messages[id]
+	if len(reactions) == 0 {
+		return nil
+	}
+	out := make([]*pb.Reaction, len(reactions))
+	for i, reaction := range reactions {
+		out[i] = proto.Clone(reaction).(*pb.Reaction)
+	}
+	return out
+}
+
+func indexOf(users []string, user string) int {
+	for i, u := range users {
+		if u == user {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *ChatServerCmd) React(ctx context.Context, request *pb.ReactRequest) (*pb.ReactResponse, error) {
+	emoji := request.Emoji
+	switch {
+	case emoji == "":
+		return nil, status.Error(codes.InvalidArgument, "emoji can't be empty")
+	case len(emoji) > maxEmojiLength:
+		return nil, status.Errorf(codes.InvalidArgument, "emoji can't be longer than %d bytes", maxEmojiLength)
+	case strings.ContainsAny(emoji, " \t\r\n"):
+		return nil, status.Error(codes.InvalidArgument, "emoji can't contain whitespace")
+	}
+	rm, err := s.roomOrConversation(ctx, request.Room, request.Peer)
+	if err != nil {
+		return nil, err
+	}
+	original, err := s.message(rm, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+
+	// reacting twice the same way, or taking back a reaction that isn't there, changes nothing
+	user := userFromContext(ctx)
+	if rm.reactions.has(original.Id, emoji, user) != request.Remove {
+		return &pb.ReactResponse{Reactions: original.Reactions}, nil
+	}
+	msg, err := s.storeEvent(ctx, rm, original, &pb.ChatMessage{
+		Payload: &pb.ChatMessage_Reaction{Reaction: &pb.ReactionEvent{MessageId: original.Id, Emoji: emoji, Removed: request.Remove}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("reacted to message", "room", rm.name, "id", original.Id, "user", user, "emoji", emoji, "removed", request.Remove, "eventId", msg.Id)
+	return &pb.ReactResponse{Id: msg.Id, Reactions: rm.reactions.get(original.Id)}, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc"
+	grpcbackoff "google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// sendTimeout limits a single attempt of sending a message.
+const sendTimeout = 5 * time.Second
+
+// reconnectOptions are the cli options controlling how clients recover from a lost connection.
+type reconnectOptions struct {
+	ReconnectMin time.Duration `help:"delay before the first reconnection attempt after the connection to the server is lost" default:"500ms"`
+	ReconnectMax time.Duration `help:"maximum delay between reconnection attempts" default:"30s"`
+
+	Keepalive        time.Duration `help:"how often to ping the server while streams are open to find out about dead connections, 0 disables pings" default:"30s"`
+	KeepaliveTimeout time.Duration `help:"how long to wait for the answer to a ping before considering the connection dead" default:"10s"`
+}
+
+func (o reconnectOptions) validate() error {
+	if o.ReconnectMin <= 0 {
+		return fmt.Errorf("--reconnect-min has to be positive, got %s", o.ReconnectMin)
+	}
+	if o.ReconnectMax < o.ReconnectMin {
+		return fmt.Errorf("--reconnect-max (%s) can't be lower than --reconnect-min (%s)", o.ReconnectMax, o.ReconnectMin)
+	}
+	return nil
+}
+
+func (o reconnectOptions) backoff() *backoff {
+	return &backoff{min: o.ReconnectMin, max: o.ReconnectMax}
+}
+
+// dialOptions make the transport reconnect with the same delays as the streams on top of it, and ping the server to
+// notice a connection that died without being closed.
+func (o reconnectOptions) dialOptions() []grpc.DialOption {
+	config := grpcbackoff.DefaultConfig
+	config.BaseDelay = o.ReconnectMin
+	config.MaxDelay = o.ReconnectMax
+	options := []grpc.DialOption{grpc.WithConnectParams(grpc.ConnectParams{Backoff: config, MinConnectTimeout: 5 * time.Second})}
+	if o.Keepalive > 0 {
+		// servers close the connections of clients pinging more often than they allow, 10s unless configured otherwise
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: o.Keepalive, Timeout: o.KeepaliveTimeout}))
+	}
+	return options
+}
+
+// backoff computes exponentially growing delays with full jitter, so clients disconnected at the same time don't all
+// come back at the same time.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func (b *backoff) Next() time.Duration {
+	d := b.min << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return b.min + time.Duration(rand.Int63n(int64(d-b.min)+1))
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// inRoom tells whether a message belongs to the room a stream receives, rather than being a direct message delivered
+// on it.
+func inRoom(msg *pb.ReceiveResponse, room string) bool {
+	if room == "" {
+		room = defaultRoom
+	}
+	// servers predating rooms leave it empty
+	return msg.Room == "" || msg.Room == room
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryable tells apart errors caused by a broken connection or an overloaded server, which go away by trying
+// again, from errors which won't. Internal and Unknown errors are bugs or failures like a full disk on the server,
+// retrying them would only spin.
+func isRetryable(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// send delivers a message, retrying with backoff delays for as long as the server is unreachable. Only errors which
+// retrying won't fix are returned.
+func send(ctx context.Context, pbClient pb.ChatServerClient, request *pb.SendRequest, options reconnectOptions, onRetry func(err error, retryIn time.Duration)) (*pb.SendResponse, error) {
+	b := options.backoff()
+	for {
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		resp, err := pbClient.Send(sendCtx, request)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) {
+			return nil, err
+		}
+		delay := b.Next()
+		onRetry(err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// watchConnection calls fn with the state of the connection whenever it changes, until ctx is done.
+func watchConnection(ctx context.Context, conn *grpc.ClientConn, fn func(state connectivity.State)) {
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		fn(state)
+		if state == connectivity.Shutdown || !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// streamState is reported by subscribe whenever the stream connects or breaks.
+type streamState string
+
+const (
+	streamConnected    streamState = "connected"
+	streamDisconnected streamState = "disconnected"
+)
+
+// subscribe receives the messages of a room until ctx is done. Whenever the stream breaks it re-subscribes after a
+// backoff delay, asking for everything after the last received message, so nothing is missed. Only errors which
+// retrying won't fix are returned.
+func subscribe(ctx context.Context, pbClient pb.ChatServerClient, request *pb.ReceiveRequest, options reconnectOptions, onMessage func(*pb.ReceiveResponse) error, onState func(state streamState, err error, retryIn time.Duration)) error {
+	b := options.backoff()
+	request = proto.Clone(request).(*pb.ReceiveRequest)
+	request.Heartbeats = true
+	for {
+		err := receive(ctx, pbClient, request, func(msg *pb.ReceiveResponse) error {
+			b.Reset()
+			// servers predating the envelope only fill the flat fields
+			normalize(msg)
+			if msg.Id > 0 && inRoom(msg, request.Room) {
+				// system events have no id, direct messages have ids of their conversation
+				request.LastId = msg.Id
+			}
+			return onMessage(msg)
+		}, func() {
+			onState(streamConnected, nil, 0)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		delay := b.Next()
+		onState(streamDisconnected, err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil
+		}
+	}
+}
+
+// receive runs a single Receive stream until it breaks. Heartbeats aren't passed on, but once the server sent one, the
+// stream is given up on when it stays silent for too long.
+func receive(ctx context.Context, pbClient pb.ChatServerClient, request *pb.ReceiveRequest, onMessage func(*pb.ReceiveResponse) error, onConnected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pbClient.Receive(ctx, request)
+	if err != nil {
+		return err
+	}
+	// the stream is only known to work once the server answered, headers are sent as soon as it accepted the call
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+	onConnected()
+
+	var silent atomic.Bool
+	var watchdog *time.Timer
+	defer func() {
+		if watchdog != nil {
+			watchdog.Stop()
+		}
+	}()
+	var interval time.Duration
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if silent.Load() {
+				return status.Errorf(codes.Unavailable, "no heartbeat from the server for %s", missedHeartbeats*interval)
+			}
+			return err
+		}
+		heartbeat := msg.ChatMessage.GetHeartbeat()
+		if d := heartbeat.GetInterval().AsDuration(); d > 0 {
+			interval = d
+		}
+		if interval > 0 {
+			if watchdog == nil {
+				watchdog = time.AfterFunc(missedHeartbeats*interval, func() {
+					silent.Store(true)
+					cancel()
+				})
+			} else {
+				watchdog.Reset(missedHeartbeats * interval)
+			}
+		}
+		if heartbeat != nil {
+			continue
+		}
+		if err := onMessage(msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, time.Second
+	b := &backoff{min: min, max: max}
+	// the upper bound doubles with every attempt until it reaches max
+	for _, upper := range []time.Duration{min, 2 * min, 4 * min, 8 * min, max, max, max} {
+		d := b.Next()
+		if d < min || d > upper {
+			t.Fatalf("attempt %d: delay %s isn't within [%s, %s]", b.attempt, d, min, upper)
+		}
+	}
+	if b.attempt != 4 {
+		t.Fatalf("attempt is %d after reaching max, want 4", b.attempt)
+	}
+
+	b.Reset()
+	if d := b.Next(); d != min {
+		t.Fatalf("first delay after reset is %s, want %s", d, min)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	min, max := 10*time.Millisecond, 80*time.Millisecond
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		b := &backoff{min: min, max: max, attempt: 3}
+		d := b.Next()
+		if d < min || d > max {
+			t.Fatalf("delay %s isn't within [%s, %s]", d, min, max)
+		}
+		seen[d] = true
+	}
+	// full jitter spreads the delays over the whole range
+	if len(seen) < 100 {
+		t.Fatalf("only %d distinct delays in 1000 attempts", len(seen))
+	}
+}
+
+func TestBackoffDoesNotOverflow(t *testing.T) {
+	b := &backoff{min: time.Second, max: time.Hour}
+	for i := 0; i < 100; i++ {
+		if d := b.Next(); d < time.Second || d > time.Hour {
+			t.Fatalf("attempt %d: delay %s isn't within [1s, 1h]", i, d)
+		}
+	}
+	b = &backoff{min: time.Second, max: time.Second}
+	for i := 0; i < 5; i++ {
+		if d := b.Next(); d != time.Second {
+			t.Fatalf("delay %s with min and max equal, want 1s", d)
+		}
+	}
+}
+
+func TestReconnectOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		min, max time.Duration
+		valid    bool
+	}{
+		{min: 500 * time.Millisecond, max: 30 * time.Second, valid: true},
+		{min: time.Second, max: time.Second, valid: true},
+		{min: time.Second, max: 500 * time.Millisecond},
+		{min: 0, max: time.Second},
+		{min: -time.Second, max: time.Second},
+	} {
+		err := reconnectOptions{ReconnectMin: tc.min, ReconnectMax: tc.max}.validate()
+		if (err == nil) != tc.valid {
+			t.Errorf("min %s, max %s: got %v, want valid %v", tc.min, tc.max, err, tc.valid)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: status.Error(codes.Unavailable, "connection refused"), retryable: true},
+		{err: status.Error(codes.ResourceExhausted, "too many requests"), retryable: true},
+		{err: status.Error(codes.Aborted, "conflict"), retryable: true},
+		{err: status.Error(codes.DeadlineExceeded, "timeout"), retryable: true},
+		{err: io.EOF, retryable: true},
+		{err: fmt.Errorf("failed to receive: %w", io.EOF), retryable: true},
+		{err: status.Error(codes.Internal, "disk full")},
+		{err: status.Error(codes.Unknown, "panic")},
+		{err: status.Error(codes.InvalidArgument, "bad request")},
+		{err: status.Error(codes.NotFound, "no such room")},
+		{err: status.Error(codes.Unauthenticated, "invalid token")},
+		{err: status.Error(codes.PermissionDenied, "not an admin")},
+		{err: status.Error(codes.FailedPrecondition, "not enabled")},
+		{err: status.Error(codes.Canceled, "canceled")},
+		{err: errors.New("something else")},
+	} {
+		if got := isRetryable(tc.err); got != tc.retryable {
+			t.Errorf("%v: retryable is %v, want %v", tc.err, got, tc.retryable)
+		}
+	}
+}
+
+func TestInRoom(t *testing.T) {
+	for _, tc := range []struct {
+		msgRoom, room string
+		in            bool
+	}{
+		{msgRoom: "general", room: "general", in: true},
+		{msgRoom: "general", room: "", in: true},
+		{msgRoom: "", room: "lobby", in: true},
+		{msgRoom: "lobby", room: "general"},
+		{msgRoom: "lobby", room: ""},
+		{msgRoom: "@alice,bob", room: "general"},
+	} {
+		if got := inRoom(&pb.ReceiveResponse{Room: tc.msgRoom}, tc.room); got != tc.in {
+			t.Errorf("message of %q in stream of %q: got %v, want %v", tc.msgRoom, tc.room, got, tc.in)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultRoom = "general"
+
+var roomNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// room is a named channel with its own message log and subscribers. Message ids are assigned per room.
+type room struct {
+	name        string
+	subscribers sync.Map
+
+	mu        sync.Mutex // serializes appending to the log and queueing for broadcast, so messages are broadcast in id order
+	log       *wal
+	keys      *idempotencyKeys
+	index     *searchIndex
+	edits     *messageEdits
+	reactions *messageReactions
+	threads   *messageThreads
+	deleted   bool
+
+	replicated chan struct{} // closed and replaced whenever a message copied from another server was stored
+
+	presence *presence
+	typing   *typingState
+}
+
+// idempotencyKeys remembers the idempotency keys of the messages stored within a time window, so retried sends can be
+// recognized.
+type idempotencyKeys struct {
+	window time.Duration
+	ids    map[string]int32
+	order  []idempotencyKey // oldest first
+}
+
+type idempotencyKey struct {
+	key string
+	at  time.Time
+}
+
+func newIdempotencyKeys(window time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{window: window, ids: map[string]int32{}}
+}
+
+func (k *idempotencyKeys) get(key string) (int32, bool) {
+	k.expire(time.Now())
+	id, ok := k.ids[key]
+	return id, ok
+}
+
+func (k *idempotencyKeys) add(key string, id int32, at time.Time) {
+	if key == "" || time.Since(at) > k.window {
+		return
+	}
+	k.ids[key] = id
+	k.order = append(k.order, idempotencyKey{key: key, at: at})
+}
+
+func (k *idempotencyKeys) expire(now time.Time) {
+	i := 0
+	for ; i < len(k.order) && now.Sub(k.order[i].at) > k.window; i++ {
+		delete(k.ids, k.order[i].key)
+	}
+	k.order = k.order[i:]
+}
+
+// broadcast is a message waiting in ChatServerCmd.messagesChannel to be fanned out to the subscribers of its room.
+type broadcast struct {
+	room *room
+	msg  *pb.ReceiveResponse
+
+	// received from another server of the cluster, so it's not published again
+	remote bool
+
+	// set instead of room and msg to be told when everything queued before has been broadcast
+	flushed chan struct{}
+}
+
+// roomOptions configure the message logs of all rooms.
+type roomOptions struct {
+	segmentSize  int64
+	syncMode     walSyncMode
+	syncInterval time.Duration
+	dedupWindow  time.Duration
+}
+
+// roomRegistry keeps track of all rooms. Every room is a directory holding its message log.
+type roomRegistry struct {
+	dir     string
+	options roomOptions
+
+	mu    sync.RWMutex
+	rooms map[string]*room
+}
+
+func openRoomRegistry(dir string, options roomOptions) (*roomRegistry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create rooms directory: %w", err)
+	}
+	r := &roomRegistry{
+		dir:     dir,
+		options: options,
+		rooms:   map[string]*room{},
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !roomNameRegexp.MatchString(e.Name()) {
+			continue
+		}
+		if _, err := r.open(e.Name()); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if _, ok := r.rooms[defaultRoom]; !ok {
+		if _, err := r.open(defaultRoom); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// migrateLegacyLog moves a message log left at the top of the data directory by versions predating rooms into the
+// directory of the default room, which is where its messages belong now.
+func migrateLegacyLog(dataDir, roomsDir string) (bool, error) {
+	segments, err := filepath.Glob(filepath.Join(dataDir, "*"+walSegmentSuffix))
+	if err != nil || len(segments) == 0 {
+		return false, err
+	}
+	target := filepath.Join(roomsDir, defaultRoom)
+	if existing, err := filepath.Glob(filepath.Join(target, "*"+walSegmentSuffix)); err != nil {
+		return false, err
+	} else if len(existing) > 0 {
+		return false, fmt.Errorf("found a message log in both %s and %s, move one of them away", dataDir, target)
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return false, fmt.Errorf("failed to create room directory: %w", err)
+	}
+	for _, segment := range segments {
+		if err := os.Rename(segment, filepath.Join(target, filepath.Base(segment))); err != nil {
+			return false, fmt.Errorf("failed to move message log: %w", err)
+		}
+	}
+	return true, nil
+}
+
+func (r *roomRegistry) open(name string) (*room, error) {
+	rm, err := openRoom(filepath.Join(r.dir, name), name, r.options)
+	if err != nil {
+		return nil, err
+	}
+	r.rooms[name] = rm
+	return rm, nil
+}
+
+// openRoom opens the message log in dir as a room with the given name.
+func openRoom(dir, name string, options roomOptions) (*room, error) {
+	log, err := openWAL(dir, options.segmentSize, options.syncMode, options.syncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message log of room %s: %w", name, err)
+	}
+	rm := &room{name: name, log: log, keys: newIdempotencyKeys(options.dedupWindow), index: newSearchIndex(), edits: newMessageEdits(), reactions: newMessageReactions(), threads: newMessageThreads(), presence: newPresence(), typing: newTypingState(), replicated: make(chan struct{})}
+
+	// remember the idempotency keys of recent messages, so retries spanning a restart are recognized too, index all
+	// messages for searching and collect their edits
+	err = rm.replay(0, func(msg *pb.ReceiveResponse) error {
+		rm.keys.add(msg.IdempotencyKey, msg.Id, msg.Timestamp.AsTime())
+		rm.track(msg.ChatMessage)
+		return nil
+	})
+	if err != nil {
+		log.Close()
+		return nil, fmt.Errorf("failed to read message log of room %s: %w", name, err)
+	}
+	return rm, nil
+}
+
+// Get returns the room with the given name, an empty name means the default room.
+func (r *roomRegistry) Get(name string) (*room, error) {
+	if name == "" {
+		name = defaultRoom
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rm, ok := r.rooms[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "room %q does not exist", name)
+	}
+	return rm, nil
+}
+
+func (r *roomRegistry) Create(name string) (*room, error) {
+	if !roomNameRegexp.MatchString(name) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid room name %q, it has to match %s", name, roomNameRegexp.String())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.rooms[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "room %q already exists", name)
+	}
+	return r.open(name)
+}
+
+// Delete removes a room together with its history and disconnects its subscribers.
+func (r *roomRegistry) Delete(name string) error {
+	if name == defaultRoom {
+		return status.Errorf(codes.FailedPrecondition, "the default room %q can't be deleted", defaultRoom)
+	}
+	r.mu.Lock()
+	rm, ok := r.rooms[name]
+	if !ok {
+		r.mu.Unlock()
+		return status.Errorf(codes.NotFound, "room %q does not exist", name)
+	}
+	delete(r.rooms, name)
+	r.mu.Unlock()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.deleted = true
+	rm.subscribers.Range(func(key, value interface{}) bool {
+		if sub, ok := value.(*subscriber); ok {
+			sub.finish(status.Errorf(codes.NotFound, "room %q was deleted", name))
+		}
+		return true
+	})
+	if err := rm.log.Close(); err != nil {
+		return fmt.Errorf("failed to close message log of room %s: %w", name, err)
+	}
+	if err := os.RemoveAll(filepath.Join(r.dir, name)); err != nil {
+		return fmt.Errorf("failed to remove message log of room %s: %w", name, err)
+	}
+	return nil
+}
+
+// List returns all rooms sorted by name.
+func (r *roomRegistry) List() []*room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rooms := make([]*room, 0, len(r.rooms))
+	for _, rm := range r.rooms {
+		rooms = append(rooms, rm)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	return rooms
+}
+
+func (r *roomRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for _, rm := range r.rooms {
+		if err := rm.log.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// append stores a message in the room's log and hands it over to the broadcast goroutine. A message with an
+// idempotency key which was stored before is not stored again, it gets the id of the earlier message and duplicate is
+// true.
+func (rm *room) append(msg *pb.ReceiveResponse, messagesChannel chan<- broadcast) (duplicate bool, err error) {
+	data, err := proto.Marshal(storedForm(msg))
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.deleted {
+		return false, status.Errorf(codes.NotFound, "room %q does not exist", rm.name)
+	}
+	if msg.IdempotencyKey != "" {
+		if id, ok := rm.keys.get(msg.IdempotencyKey); ok {
+			msg.Id = id
+			msg.Room = rm.name
+			normalize(msg)
+			return true, nil
+		}
+	}
+	id, err := rm.log.Append(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to store message: %w", err)
+	}
+	msg.Id = int32(id)
+	msg.Room = rm.name
+	normalize(msg)
+	rm.keys.add(msg.IdempotencyKey, msg.Id, msg.Timestamp.AsTime())
+	rm.track(msg.ChatMessage)
+	messagesChannel <- broadcast{room: rm, msg: msg}
+	return false, nil
+}
+
+// replicate stores a copy of a message which another server of the cluster stored first and broadcasts it. Copies
+// have to come in id order, those which are already there are skipped.
+func (rm *room) replicate(msg *pb.ReceiveResponse, messagesChannel chan<- broadcast) error {
+	data, err := proto.Marshal(storedForm(msg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.deleted {
+		return status.Errorf(codes.NotFound, "room %q does not exist", rm.name)
+	}
+	last := int32(rm.log.LastIndex())
+	if msg.Id <= last {
+		return nil
+	}
+	if msg.Id > last+1 {
+		return fmt.Errorf("messages %d to %d of room %s are missing", last+1, msg.Id-1, rm.name)
+	}
+	if _, err := rm.log.Append(data); err != nil {
+		return fmt.Errorf("failed to store message: %w", err)
+	}
+	msg.Room = rm.name
+	normalize(msg)
+	rm.keys.add(msg.IdempotencyKey, msg.Id, msg.Timestamp.AsTime())
+	rm.track(msg.ChatMessage)
+	close(rm.replicated)
+	rm.replicated = make(chan struct{})
+	messagesChannel <- broadcast{room: rm, msg: msg, remote: true}
+	return nil
+}
+
+// waitReplicated waits until the message with the given id was copied to the room from another server, ctx is done
+// or timeout passes. It returns whether the message is there.
+func (rm *room) waitReplicated(ctx context.Context, id int32, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		rm.mu.Lock()
+		last, replicated := int32(rm.log.LastIndex()), rm.replicated
+		rm.mu.Unlock()
+		if last >= id {
+			return true
+		}
+		select {
+		case <-replicated:
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// read calls fn for every stored message with an id greater than lastId, as it was stored.
+func (rm *room) read(lastId int32, fn func(msg *pb.ReceiveResponse) error) error {
+	if lastId < 0 {
+		lastId = 0
+	}
+	return rm.log.ReadFrom(uint64(lastId)+1, func(index uint64, data []byte) error {
+		msg := &pb.ReceiveResponse{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return fmt.Errorf("failed to unmarshal message %d: %w", index, err)
+		}
+		msg.Id = int32(index)
+		msg.Room = rm.name
+		normalize(msg)
+		return fn(msg)
+	})
+}
+
+// replay calls fn for every stored message with an id greater than lastId. Messages are passed as they are now, with
+// their edits applied, their reactions and the number of replies to them.
+func (rm *room) replay(lastId int32, fn func(msg *pb.ReceiveResponse) error) error {
+	return rm.read(lastId, func(msg *pb.ReceiveResponse) error {
+		if rm.edits.apply(msg.ChatMessage) {
+			normalize(msg)
+		}
+		if !msg.ChatMessage.Deleted {
+			msg.ChatMessage.Reactions = rm.reactions.get(msg.Id)
+		}
+		msg.ChatMessage.ReplyCount = int32(rm.threads.count(msg.Id))
+		return fn(msg)
+	})
+}
+
+// messages returns the stored messages with the given ids, which have to be in ascending order.
+func (rm *room) messages(ids []int32) ([]*pb.ChatMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	found := make([]*pb.ChatMessage, 0, len(ids))
+	err := rm.replay(ids[0]-1, func(msg *pb.ReceiveResponse) error {
+		if msg.Id == ids[len(found)] {
+			found = append(found, msg.ChatMessage)
+			if len(found) == len(ids) {
+				return errPageFull
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, err
+	}
+	return found, nil
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// errPageFull stops reading the log once a page of history is complete.
+var errPageFull = errors.New("page full")
+
+// historyQuery selects stored messages of a room, see pb.HistoryRequest.
+type historyQuery struct {
+	since, until time.Time // zero if unbounded
+	author       string
+	cursor       int32
+	backward     bool
+	limit        int
+}
+
+func newHistoryQuery(request *pb.HistoryRequest) (historyQuery, error) {
+	q := historyQuery{
+		author:   request.Author,
+		cursor:   request.Cursor,
+		backward: request.Direction == pb.HistoryRequest_DIRECTION_BACKWARD,
+		limit:    int(request.Limit),
+	}
+	if request.Since != nil {
+		q.since = request.Since.AsTime()
+	}
+	if request.Until != nil {
+		q.until = request.Until.AsTime()
+	}
+	switch {
+	case q.cursor < 0:
+		return q, status.Error(codes.InvalidArgument, "cursor can't be negative")
+	case q.limit < 0:
+		return q, status.Error(codes.InvalidArgument, "limit can't be negative")
+	case !q.since.IsZero() && !q.until.IsZero() && !q.since.Before(q.until):
+		return q, status.Error(codes.InvalidArgument, "since has to be before until")
+	case q.limit == 0:
+		q.limit = defaultHistoryLimit
+	case q.limit > maxHistoryLimit:
+		q.limit = maxHistoryLimit
+	}
+	return q, nil
+}
+
+func (q historyQuery) matches(cm *pb.ChatMessage) bool {
+	if q.author != "" && cm.Author != q.author {
+		return false
+	}
+	ts := cm.Timestamp.AsTime()
+	if !q.since.IsZero() && ts.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !ts.Before(q.until) {
+		return false
+	}
+	return true
+}
+
+// history returns a page of the messages matching q, oldest first, and the cursor of the next page, which is 0 if
+// there are no more messages.
+func (rm *room) history(q historyQuery) ([]*pb.ChatMessage, int32, error) {
+	if q.backward {
+		return rm.historyBackward(q)
+	}
+	var page []*pb.ChatMessage
+	more := false
+	err := rm.replay(q.cursor, func(msg *pb.ReceiveResponse) error {
+		if !q.matches(msg.ChatMessage) {
+			return nil
+		}
+		if len(page) == q.limit {
+			more = true
+			return errPageFull
+		}
+		page = append(page, msg.ChatMessage)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, 0, err
+	}
+	if !more {
+		return page, 0, nil
+	}
+	return page, page[len(page)-1].Id, nil
+}
+
+// historyBackward reads the log in windows from the cursor towards its beginning, as it can only be read forward.
+func (rm *room) historyBackward(q historyQuery) ([]*pb.ChatMessage, int32, error) {
+	to := q.cursor - 1
+	if q.cursor == 0 {
+		to = int32(rm.log.LastIndex())
+	}
+	window := int32(4 * q.limit)
+	if window < 256 {
+		window = 256
+	}
+
+	var page []*pb.ChatMessage // newest first until it's reversed below
+	more := false
+	for to >= 1 && !more {
+		from := to - window + 1
+		if from < 1 {
+			from = 1
+		}
+		var chunk []*pb.ChatMessage
+		err := rm.replay(from-1, func(msg *pb.ReceiveResponse) error {
+			if msg.Id > to {
+				return errPageFull
+			}
+			if q.matches(msg.ChatMessage) {
+				chunk = append(chunk, msg.ChatMessage)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageFull) {
+			return nil, 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if len(page) == q.limit {
+				more = true
+				break
+			}
+			page = append(page, chunk[i])
+		}
+		to = from - 1
+	}
+
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	if !more {
+		return page, 0, nil
+	}
+	return page, page[0].Id, nil
+}
+
+func (rm *room) info() *pb.Room {
+	var subscribers int32
+	rm.subscribers.Range(func(key, value interface{}) bool {
+		subscribers++
+		return true
+	})
+	return &pb.Room{
+		Name:        rm.name,
+		LastId:      int32(rm.log.LastIndex()),
+		Subscribers: subscribers,
+	}
+}
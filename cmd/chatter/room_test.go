@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var historyEpoch = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// newHistoryRoom returns a room with n messages spread over small segments. Message i was sent i-1 minutes after
+// historyEpoch, by carol if i is a multiple of 250 and by alice or bob otherwise.
+func newHistoryRoom(t *testing.T, n int) *room {
+	t.Helper()
+	rm, err := openRoom(t.TempDir(), "general", roomOptions{segmentSize: 1024, syncMode: walSyncNever, syncInterval: time.Second, dedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.log.Close() })
+	messages := make(chan broadcast, n)
+	for i := 1; i <= n; i++ {
+		cm := textMessage(fmt.Sprintf("message %d", i))
+		cm.Author = []string{"alice", "bob"}[i%2]
+		if i%250 == 0 {
+			cm.Author = "carol"
+		}
+		cm.Timestamp = timestamppb.New(historyEpoch.Add(time.Duration(i-1) * time.Minute))
+		if _, err := rm.append(&pb.ReceiveResponse{ChatMessage: cm}, messages); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rm
+}
+
+// idRange returns the ids from to to, inclusive.
+func idRange(from, to int32) []int32 {
+	var ids []int32
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestHistory(t *testing.T) {
+	rm := newHistoryRoom(t, 600)
+	if len(rm.log.segments) < 10 {
+		t.Fatalf("log has %d segments, want pages to cross segments", len(rm.log.segments))
+	}
+	at := func(minutes int) time.Time { return historyEpoch.Add(time.Duration(minutes) * time.Minute) }
+
+	for _, tc := range []struct {
+		name  string
+		query historyQuery
+		ids   []int32
+		next  int32
+	}{
+		{name: "first page", query: historyQuery{limit: 10}, ids: idRange(1, 10), next: 10},
+		{name: "second page", query: historyQuery{cursor: 10, limit: 10}, ids: idRange(11, 20), next: 20},
+		{name: "page across segments", query: historyQuery{cursor: 5, limit: 100}, ids: idRange(6, 105), next: 105},
+		{name: "last page", query: historyQuery{cursor: 590, limit: 10}, ids: idRange(591, 600)},
+		{name: "short last page", query: historyQuery{cursor: 595, limit: 10}, ids: idRange(596, 600)},
+		{name: "after the last message", query: historyQuery{cursor: 600, limit: 10}},
+		{name: "beyond the log", query: historyQuery{cursor: 1000, limit: 10}},
+		{name: "by author", query: historyQuery{author: "carol", limit: 10}, ids: []int32{250, 500}},
+		{name: "by author paged", query: historyQuery{author: "carol", limit: 1}, ids: []int32{250}, next: 250},
+		{name: "since and until", query: historyQuery{since: at(10), until: at(20), limit: 100}, ids: idRange(11, 20)},
+
+		{name: "backward first page", query: historyQuery{backward: true, limit: 10}, ids: idRange(591, 600), next: 591},
+		{name: "backward second page", query: historyQuery{backward: true, cursor: 591, limit: 10}, ids: idRange(581, 590), next: 581},
+		{name: "backward last page", query: historyQuery{backward: true, cursor: 11, limit: 10}, ids: idRange(1, 10)},
+		{name: "backward short last page", query: historyQuery{backward: true, cursor: 6, limit: 10}, ids: idRange(1, 5)},
+		{name: "before the first message", query: historyQuery{backward: true, cursor: 1, limit: 10}},
+		{name: "backward across windows", query: historyQuery{backward: true, author: "carol", limit: 10}, ids: []int32{250, 500}},
+		{name: "backward across windows paged", query: historyQuery{backward: true, author: "carol", limit: 1}, ids: []int32{500}, next: 500},
+		{name: "backward after a paged window", query: historyQuery{backward: true, author: "carol", cursor: 500, limit: 1}, ids: []int32{250}},
+		{name: "backward page larger than a window", query: historyQuery{backward: true, cursor: 401, limit: 300}, ids: idRange(101, 400), next: 101},
+		{name: "backward since and until", query: historyQuery{backward: true, since: at(10), until: at(20), limit: 5}, ids: idRange(16, 20), next: 16},
+	} {
+		page, next, err := rm.history(tc.query)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var ids []int32
+		for _, cm := range page {
+			ids = append(ids, cm.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) || next != tc.next {
+			t.Errorf("%s: got %v and cursor %d, want %v and %d", tc.name, ids, next, tc.ids, tc.next)
+		}
+	}
+}
+
+func TestHistoryEmptyLog(t *testing.T) {
+	rm := newHistoryRoom(t, 0)
+	for _, backward := range []bool{false, true} {
+		page, next, err := rm.history(historyQuery{backward: backward, limit: 10})
+		if err != nil || len(page) != 0 || next != 0 {
+			t.Errorf("backward %v: got %d messages, cursor %d, %v", backward, len(page), next, err)
+		}
+	}
+}
+
+func TestNewHistoryQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request *pb.HistoryRequest
+		limit   int
+		invalid bool
+	}{
+		{name: "default limit", request: &pb.HistoryRequest{}, limit: defaultHistoryLimit},
+		{name: "limit", request: &pb.HistoryRequest{Limit: 10}, limit: 10},
+		{name: "maximum limit", request: &pb.HistoryRequest{Limit: maxHistoryLimit}, limit: maxHistoryLimit},
+		{name: "clamped limit", request: &pb.HistoryRequest{Limit: 5000}, limit: maxHistoryLimit},
+		{name: "negative limit", request: &pb.HistoryRequest{Limit: -1}, invalid: true},
+		{name: "negative cursor", request: &pb.HistoryRequest{Cursor: -1}, invalid: true},
+		{name: "since after until", request: &pb.HistoryRequest{Since: timestamppb.New(historyEpoch.Add(time.Hour)), Until: timestamppb.New(historyEpoch)}, invalid: true},
+		{name: "since equal to until", request: &pb.HistoryRequest{Since: timestamppb.New(historyEpoch), Until: timestamppb.New(historyEpoch)}, invalid: true},
+	} {
+		q, err := newHistoryQuery(tc.request)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%s: was accepted", tc.name)
+			}
+			continue
+		}
+		if err != nil || q.limit != tc.limit {
+			t.Errorf("%s: got limit %d, %v, want %d", tc.name, q.limit, err, tc.limit)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	rm := newHistoryRoom(t, 100)
+	found, err := rm.messages([]int32{3, 40, 41, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int32
+	for _, cm := range found {
+		ids = append(ids, cm.Id)
+	}
+	if !reflect.DeepEqual(ids, []int32{3, 40, 41, 100}) {
+		t.Fatalf("got %v", ids)
+	}
+	if found, err := rm.messages(nil); err != nil || found != nil {
+		t.Fatalf("no ids gave %v, %v", found, err)
+	}
+}
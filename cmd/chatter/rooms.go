@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+)
+
+type ChatRoomsCmd struct {
+	List   ChatRoomsListCmd   `cmd:"" help:"List rooms."`
+	Create ChatRoomsCreateCmd `cmd:"" help:"Create a room."`
+	Delete ChatRoomsDeleteCmd `cmd:"" help:"Delete a room and its history."`
+}
+
+// serverConnection holds the options shared by the commands making a single call to the server.
+type serverConnection struct {
+	Addr    string        `help:"address to connect to" default:":8080"`
+	Timeout time.Duration `help:"timeout of the request" default:"5s"`
+
+	clientTLSOptions  `embed:""`
+	clientAuthOptions `embed:""`
+}
+
+func (r serverConnection) call(fn func(ctx context.Context, pbClient pb.ChatServerClient) error) error {
+	conn, err := dial(r.Addr, r.clientTLSOptions, r.clientAuthOptions)
+	if err != nil {
+		return fmt.Errorf("failed to dial server: %w", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	return fn(ctx, pb.NewChatServerClient(conn))
+}
+
+type ChatRoomsListCmd struct {
+	serverConnection `embed:""`
+}
+
+func (l *ChatRoomsListCmd) Run(cmdCtx *cmdContext) error {
+	return l.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+		resp, err := pbClient.ListRooms(ctx, &pb.ListRoomsRequest{})
+		if err != nil {
+			return fmt.Errorf("failed to list rooms: %w", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tMESSAGES\tSUBSCRIBERS")
+		for _, r := range resp.Rooms {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", r.Name, r.LastId, r.Subscribers)
+		}
+		return w.Flush()
+	})
+}
+
+type ChatRoomsCreateCmd struct {
+	serverConnection `embed:""`
+	Name             string `arg:"" help:"name of the room"`
+}
+
+func (c *ChatRoomsCreateCmd) Run(cmdCtx *cmdContext) error {
+	return c.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+		if _, err := pbClient.CreateRoom(ctx, &pb.CreateRoomRequest{Name: c.Name}); err != nil {
+			return fmt.Errorf("failed to create room: %w", err)
+		}
+		cmdCtx.Logger.Info("room created", "room", c.Name)
+		return nil
+	})
+}
+
+type ChatRoomsDeleteCmd struct {
+	serverConnection `embed:""`
+	Name             string `arg:"" help:"name of the room"`
+}
+
+func (d *ChatRoomsDeleteCmd) Run(cmdCtx *cmdContext) error {
+	return d.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+		if _, err := pbClient.DeleteRoom(ctx, &pb.DeleteRoomRequest{Name: d.Name}); err != nil {
+			return fmt.Errorf("failed to delete room: %w", err)
+		}
+		cmdCtx.Logger.Info("room deleted", "room", d.Name)
+		return nil
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/term"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type ChatSearchCmd struct {
+	serverConnection `embed:""`
+
+	Query  []string `arg:"" help:"words to search for, ignoring case, put phrases in quotes and end a word with * to match every word starting with it"`
+	Room   string   `help:"room to search, all rooms if empty"`
+	Author string   `help:"only show messages of this user"`
+	Since  string   `help:"only show messages sent at or after this time, either a date, an RFC 3339 time or a duration like 2h meaning that long ago"`
+	Until  string   `help:"only show messages sent before this time, in the same formats as --since"`
+	Limit  int32    `help:"maximum number of messages to show, the newest are shown" default:"20"`
+	Output string   `short:"o" help:"output format: text or json, which prints one result per line" enum:"text,json" default:"text"`
+	Color  string   `help:"highlight matches with colors: auto, always or never" enum:"auto,always,never" default:"auto"`
+}
+
+func (c *ChatSearchCmd) Run(cmdCtx *cmdContext) error {
+	// arguments with spaces were quoted on the command line, so they're meant as phrases
+	words := make([]string, len(c.Query))
+	for i, w := range c.Query {
+		if strings.ContainsAny(w, " \t") && !strings.HasPrefix(w, `"`) {
+			w = `"` + w + `"`
+		}
+		words[i] = w
+	}
+	now := time.Now()
+	request := &pb.SearchRequest{Query: strings.Join(words, " "), Room: c.Room, Author: c.Author, Limit: c.Limit}
+	if c.Since != "" {
+		since, err := parseTimeFlag(c.Since, now)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+		request.Since = timestamppb.New(since)
+	}
+	if c.Until != "" {
+		until, err := parseTimeFlag(c.Until, now)
+		if err != nil {
+			return fmt.Errorf("invalid --until: %w", err)
+		}
+		request.Until = timestamppb.New(until)
+	}
+
+	color := c.Color == "always" || (c.Color == "auto" && term.IsTerminal(int(os.Stdout.Fd())))
+	start, end := "**", "**"
+	if color {
+		start, end = "\x1b[1;33m", "\x1b[0m"
+	}
+
+	return c.call(func(ctx context.Context, pbClient pb.ChatServerClient) error {
+		resp, err := pbClient.Search(ctx, request)
+		if err != nil {
+			return fmt.Errorf("failed to search: %w", err)
+		}
+		// oldest first, like the history
+		for i := len(resp.Results) - 1; i >= 0; i-- {
+			result := resp.Results[i]
+			if c.Output == "json" {
+				data, err := protojson.Marshal(result)
+				if err != nil {
+					return fmt.Errorf("failed to marshal result: %w", err)
+				}
+				fmt.Printf("%s\n", data)
+				continue
+			}
+			cm := result.Message
+			ts := cm.Timestamp.AsTime().Local().Format("2006-01-02 15:04:05")
+			text := highlightRanges(cm.GetText().GetText(), result.Highlights, start, end)
+			fmt.Printf("%s %s [%d] %s: %s\n", ts, cm.Room, cm.Id, cm.Author, text)
+		}
+		if c.Output == "text" && int(resp.Total) > len(resp.Results) {
+			fmt.Fprintf(os.Stderr, "showing the newest %d of %d matches\n", len(resp.Results), resp.Total)
+		}
+		return nil
+	})
+}
+
+// highlightRanges wraps the given ranges of text in start and end markers, ranges which are out of order or don't fit
+// the text are ignored.
+func highlightRanges(text string, ranges []*pb.TextRange, start, end string) string {
+	var b strings.Builder
+	last := 0
+	for _, r := range ranges {
+		s, e := int(r.Start), int(r.End)
+		if s < last || e > len(text) || s > e || !utf8.ValidString(text[s:e]) {
+			continue
+		}
+		b.WriteString(text[last:s])
+		b.WriteString(start)
+		b.WriteString(text[s:e])
+		b.WriteString(end)
+		last = e
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
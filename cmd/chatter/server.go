@@ -2,26 +2,75 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/exp/slog"
 
 	pb "github.com/mwasilew2/chatter/gen"
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ChatServerCmd struct {
 	// cli options
-	Addr string `help:"address to listen on" default:":8080"`
+	Addr            string        `help:"address to listen on" default:":8080"`
+	DataDir         string        `help:"directory to store the message logs of all rooms in" default:"data" type:"path"`
+	WalSegmentSize  int64         `help:"maximum size of a single message log segment in bytes" default:"67108864"`
+	WalSync         string        `help:"when to fsync the message log: always, interval or never" enum:"always,interval,never" default:"interval"`
+	WalSyncInterval time.Duration `help:"how often to fsync the message log when --wal-sync=interval" default:"1s"`
+	QueueSize       int           `help:"number of messages buffered for every subscriber" default:"100"`
+	OverflowPolicy  string        `help:"what to do when a subscriber's buffer is full: drop-oldest, drop-newest or disconnect" enum:"drop-oldest,drop-newest,disconnect" default:"drop-oldest"`
+	DedupWindow     time.Duration `help:"how long idempotency keys of sent messages are remembered to recognize retries" default:"24h"`
+	MetricsAddr     string        `help:"address to serve prometheus metrics on at /metrics, disabled if empty"`
+	Reflection      bool          `help:"enable grpc server reflection, so tools like grpcurl can list and call the services without the .proto file"`
+	ShutdownTimeout time.Duration `help:"how long calls get to finish when shutting down before all connections are closed, 0 closes them right away" default:"10s"`
+	TypingTimeout   time.Duration `help:"how long a member is shown as typing unless its client refreshes it" default:"5s"`
+	Admins          []string      `help:"users who may edit and delete the messages of others and delete rooms"`
+	SessionPolicy   string        `help:"what happens when a user opens another stream in a room it's already receiving: concurrent keeps all of them, replace ends the older ones" enum:"concurrent,replace" default:"concurrent"`
+	Fanout          string        `help:"how messages reach subscribers: local serves them from this server only, mesh forms a cluster with --cluster-peers" enum:"local,mesh" default:"local"`
+
+	MaxAttachmentSize int64 `help:"maximum size of an uploaded attachment in bytes" default:"10485760"`
+
+	UsersFile      string        `help:"file with users and their bcrypt password hashes, enables authentication, see the passwd command" type:"path"`
+	AuthSecretFile string        `help:"file with the key used to sign tokens, generated if missing, defaults to auth-secret in the data directory" type:"path"`
+	TokenTTL       time.Duration `help:"how long tokens issued on login are valid for" default:"24h"`
+
+	serverTLSOptions       `embed:""`
+	serverKeepaliveOptions `embed:""`
+	clusterOptions         `embed:""`
 
 	// State
-	subscribers     sync.Map
-	messagesChannel chan string
+	rooms           *roomRegistry
+	directs         *conversations
+	inboxes         *inboxes
+	blobs           *blobStore
+	auth            *authenticator
+	messagesChannel chan broadcast
+	fanout          fanout
+	droppedMessages atomic.Uint64
+	metrics         *serverMetrics
+	shutdownMu      sync.RWMutex // held for reading while a message is appended, so none slips in once draining started
+	shuttingDown    bool
+	shutdownChannel chan struct{} // closed once the last messages were broadcast, Receive streams end when it is
 
 	// Dependencies
 	logger *slog.Logger
@@ -30,21 +79,125 @@ type ChatServerCmd struct {
 	pb.UnimplementedChatServerServer
 }
 
-type subscriber struct {
-	stream          pb.ChatServer_ReceiveServer
-	finishedChannel chan<- struct{}
-}
-
 func (s *ChatServerCmd) Run(cmdCtx *cmdContext) error {
 	s.logger = cmdCtx.Logger.With("component", "ChatServerCmd")
 	s.logger.Info("starting chat server", "addr", s.Addr)
-	s.messagesChannel = make(chan string, 10)
+	// an unbuffered queue never has room for a message, dropping the oldest one would spin forever
+	if s.QueueSize < 1 {
+		return fmt.Errorf("--queue-size has to be at least 1, got %d", s.QueueSize)
+	}
+	s.messagesChannel = make(chan broadcast, 10)
+	s.shutdownChannel = make(chan struct{})
+
+	creds, err := s.serverOption()
+	if err != nil {
+		return fmt.Errorf("invalid tls options: %w", err)
+	}
+	s.metrics = newServerMetrics(s)
+	serverOptions := []grpc.ServerOption{
+		creds,
+		// first, so calls rejected by the interceptors after it are measured too
+		grpc.ChainUnaryInterceptor(s.metrics.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.metrics.streamInterceptor),
+	}
+	serverOptions = append(serverOptions, s.serverKeepaliveOptions.serverOptions()...)
+
+	// set up authentication
+	if s.UsersFile != "" {
+		if s.AuthSecretFile == "" {
+			s.AuthSecretFile = filepath.Join(s.DataDir, "auth-secret")
+		}
+		s.auth, err = newAuthenticator(s.UsersFile, s.AuthSecretFile, s.TokenTTL)
+		if err != nil {
+			return fmt.Errorf("failed to set up authentication: %w", err)
+		}
+		serverOptions = append(serverOptions,
+			grpc.ChainUnaryInterceptor(s.auth.unaryInterceptor),
+			grpc.ChainStreamInterceptor(s.auth.streamInterceptor),
+		)
+		if s.TLSCert == "" {
+			s.logger.Warn("authentication is enabled without TLS, clients only send credentials over TLS")
+		}
+	} else {
+		s.logger.Warn("authentication is disabled, all messages are sent as " + anonymousUser)
+	}
+
+	// open the rooms and their message logs
+	options := roomOptions{
+		segmentSize:  s.WalSegmentSize,
+		syncMode:     walSyncMode(s.WalSync),
+		syncInterval: s.WalSyncInterval,
+		dedupWindow:  s.DedupWindow,
+	}
+	migrated, err := migrateLegacyLog(s.DataDir, filepath.Join(s.DataDir, "rooms"))
+	if err != nil {
+		return fmt.Errorf("failed to migrate message log: %w", err)
+	}
+	if migrated {
+		s.logger.Info("moved message log into the default room", "room", defaultRoom)
+	}
+	rooms, err := openRoomRegistry(filepath.Join(s.DataDir, "rooms"), options)
+	if err != nil {
+		return fmt.Errorf("failed to open rooms: %w", err)
+	}
+	defer func() {
+		if err := rooms.Close(); err != nil {
+			s.logger.Error("failed to close rooms", "err", err)
+		}
+	}()
+	s.rooms = rooms
+	for _, rm := range rooms.List() {
+		s.logger.Info("opened room", "room", rm.name, "lastId", rm.log.LastIndex())
+	}
+	directs, err := openConversations(filepath.Join(s.DataDir, "direct"), options)
+	if err != nil {
+		return fmt.Errorf("failed to open direct conversations: %w", err)
+	}
+	defer func() {
+		if err := directs.Close(); err != nil {
+			s.logger.Error("failed to close direct conversations", "err", err)
+		}
+	}()
+	s.directs = directs
+	s.inboxes = newInboxes()
+	s.blobs, err = openBlobStore(filepath.Join(s.DataDir, "blobs"), s.MaxAttachmentSize)
+	if err != nil {
+		return fmt.Errorf("failed to open attachments: %w", err)
+	}
+
+	// connect to the other servers of the cluster
+	var mesh *meshFanout
+	switch s.Fanout {
+	case "mesh":
+		mesh, err = newMeshFanout(s, s.clusterOptions)
+		if err != nil {
+			return fmt.Errorf("failed to set up cluster: %w", err)
+		}
+		defer mesh.Close()
+		s.logger.Info("joining cluster", "node", mesh.node, "nodes", mesh.nodes)
+		s.fanout = mesh
+	default:
+		s.fanout = localFanout{messagesChannel: s.messagesChannel}
+	}
+
+	// the server reports itself as not serving until messages are broadcast and again as soon as it's shutting down
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthSrv.SetServingStatus(pb.ChatServer_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
 
 	// run goroutines
 	g := run.Group{}
 
 	// start grpc server
-	var srv *grpc.Server
+	srv := grpc.NewServer(serverOptions...)
+	pb.RegisterChatServerServer(srv, s)
+	if mesh != nil {
+		pb.RegisterClusterServer(srv, mesh)
+	}
+	healthpb.RegisterHealthServer(srv, healthSrv)
+	if s.Reflection {
+		reflection.Register(srv)
+	}
 	g.Add(func() error {
 		s.logger.Debug("starting grpc server")
 
@@ -52,23 +205,42 @@ func (s *ChatServerCmd) Run(cmdCtx *cmdContext) error {
 		if err != nil {
 			return fmt.Errorf("failed to listen: %w", err)
 		}
-		srv = grpc.NewServer()
-		pb.RegisterChatServerServer(srv, s)
-		s.logger.Info("server listening", "address", s.Addr)
+		s.logger.Info("server listening", "address", s.Addr, "tls", s.TLSCert != "", "tlsClientAuth", s.TLSClientAuth, "auth", s.auth != nil, "queueSize", s.QueueSize, "overflowPolicy", s.OverflowPolicy, "reflection", s.Reflection, "keepaliveTime", s.KeepaliveTime, "heartbeatInterval", s.HeartbeatInterval)
 		return srv.Serve(lis)
 	}, func(err error) {
 		s.logger.Debug("shutting down grpc server")
-		srv.Stop()
+		healthSrv.Shutdown()
+		s.shutdown(srv)
 		s.logger.Debug("grpc server stopped")
 	})
 
+	// serve metrics
+	if s.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+		metricsSrv := &http.Server{Addr: s.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		g.Add(func() error {
+			s.logger.Info("serving metrics", "address", s.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("failed to serve metrics: %w", err)
+			}
+			return nil
+		}, func(err error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = metricsSrv.Shutdown(ctx)
+		})
+	}
+
 	// run the broadcast goroutine which sends messages to all subscribers
 	doneBroadcast := make(chan struct{})
 	g.Add(func() error {
+		healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		healthSrv.SetServingStatus(pb.ChatServer_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
 		for {
 			select {
-			case msg := <-s.messagesChannel:
-				s.broadcastMessage(msg)
+			case b := <-s.messagesChannel:
+				s.dispatch(b)
 			case <-doneBroadcast:
 				s.logger.Debug("broadcast goroutine stopped")
 				return nil
@@ -76,9 +248,65 @@ func (s *ChatServerCmd) Run(cmdCtx *cmdContext) error {
 		}
 	}, func(err error) {
 		s.logger.Debug("shutting down broadcast goroutine")
+		healthSrv.Shutdown()
 		close(doneBroadcast)
 	})
 
+	// stop showing members as typing once their clients stopped refreshing it
+	doneTyping := make(chan struct{})
+	g.Add(func() error {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, rm := range s.rooms.List() {
+					for _, member := range rm.typing.expire(now) {
+						s.signal(rm, member, typingEvent(rm.name, member, false))
+					}
+				}
+			case <-doneTyping:
+				return nil
+			}
+		}
+	}, func(err error) {
+		close(doneTyping)
+	})
+
+	// take subscribers out of their rooms once their streams missed heartbeats
+	if s.HeartbeatInterval > 0 {
+		doneReaping := make(chan struct{})
+		g.Add(func() error {
+			ticker := time.NewTicker(s.HeartbeatInterval)
+			defer ticker.Stop()
+			total := 0
+			for {
+				select {
+				case now := <-ticker.C:
+					if reaped := s.reap(now); reaped > 0 {
+						total += reaped
+						s.logger.Info("reaped subscribers which missed heartbeats", "reaped", reaped, "total", total)
+					}
+				case <-doneReaping:
+					return nil
+				}
+			}
+		}, func(err error) {
+			close(doneReaping)
+		})
+	}
+
+	// keep copies of the rooms the other servers of the cluster own
+	if mesh != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			mesh.run(ctx)
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
 	// listen for termination signals
 	osSigChan := make(chan os.Signal, 1)
 	signal.Notify(osSigChan, os.Kill, os.Interrupt)
@@ -96,51 +324,545 @@ func (s *ChatServerCmd) Run(cmdCtx *cmdContext) error {
 		close(done)
 	})
 
-	return g.Run()
+	err = g.Run()
+	s.logger.Info("chat server stopped", "droppedMessages", s.droppedMessages.Load())
+	return err
 }
 
-func (s *ChatServerCmd) broadcastMessage(msg string) {
-	s.subscribers.Range(func(key, value interface{}) bool {
-		id, ok := key.(string)
-		if !ok {
-			s.logger.Error("error casting key to string", "key", key)
-			return false
+// dispatch delivers a message taken from messagesChannel to its subscribers and hands it to the other servers of the
+// cluster.
+func (s *ChatServerCmd) dispatch(b broadcast) {
+	if b.flushed != nil {
+		close(b.flushed)
+		return
+	}
+	if b.msg.ChatMessage.GetRecipient() != "" {
+		s.deliverDirect(b.msg)
+		s.metrics.messagesBroadcast.WithLabelValues(directMetricsRoom).Inc()
+	} else {
+		s.broadcastMessage(b.room, b.msg)
+		s.metrics.messagesBroadcast.WithLabelValues(b.room.name).Inc()
+	}
+	if !b.remote {
+		s.fanout.Publish(b.room, b.msg)
+	}
+}
+
+// shutdown stops the grpc server gracefully: new messages are refused, the ones waiting for the broadcast goroutine are
+// delivered, every Receive stream ends with a shutdown event and calls in flight get until the shutdown timeout to finish.
+func (s *ChatServerCmd) shutdown(srv *grpc.Server) {
+	s.shutdownMu.Lock()
+	s.shuttingDown = true
+	s.shutdownMu.Unlock()
+
+	// the broadcast goroutine handles the channel in order, so everything before the marker has been broadcast once it
+	// gets to it
+	flushed := make(chan struct{})
+	s.messagesChannel <- broadcast{flushed: flushed}
+	<-flushed
+	s.logger.Debug("broadcast the remaining messages")
+	close(s.shutdownChannel)
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	t := time.NewTimer(s.ShutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-stopped:
+	case <-t.C:
+		s.logger.Warn("calls didn't finish in time, closing all connections", "timeout", s.ShutdownTimeout)
+		srv.Stop()
+		<-stopped
+	}
+}
+
+// announce broadcasts an event which isn't stored, like a member joining. Events are dropped once the server is shutting
+// down.
+func (s *ChatServerCmd) announce(rm *room, msg *pb.ReceiveResponse) {
+	select {
+	case s.messagesChannel <- broadcast{room: rm, msg: msg}:
+	case <-s.shutdownChannel:
+	}
+}
+
+// signal hands an ephemeral event about a member straight to the other subscribers of a room, bypassing the log and
+// the broadcast goroutine.
+func (s *ChatServerCmd) signal(rm *room, from memberKey, msg *pb.ReceiveResponse) {
+	rm.subscribers.Range(func(key, value interface{}) bool {
+		if sub, ok := value.(*subscriber); ok && sub.member != from {
+			sub.signal(msg)
+		}
+		return true
+	})
+}
+
+// replaceSessions ends the other sessions the user of a new subscriber has in a room, telling them they were replaced.
+func (s *ChatServerCmd) replaceSessions(rm *room, newer *subscriber) {
+	rm.subscribers.Range(func(key, value interface{}) bool {
+		sub, ok := value.(*subscriber)
+		if !ok || sub == newer || sub.member.user != newer.member.user {
+			return true
 		}
-		sub, ok := value.(subscriber)
+		s.logger.Info("replacing session", "room", rm.name, "user", sub.member.user, "sessionId", sub.sessionId, "clientId", sub.clientId, "newSessionId", newer.sessionId, "newClientId", newer.clientId)
+		sub.finishWith(
+			systemEvent(rm.name, pb.SystemEvent_KIND_REPLACED, "replaced by a newer session of "+sub.member.user),
+			status.Error(codes.FailedPrecondition, "replaced by a newer session"),
+		)
+		return true
+	})
+}
+
+// broadcastMessage queues a message for every subscriber of a room. It never blocks, subscribers which can't keep up
+// are dealt with according to the overflow policy.
+func (s *ChatServerCmd) broadcastMessage(rm *room, msg *pb.ReceiveResponse) {
+	rm.subscribers.Range(func(key, value interface{}) bool {
+		sub, ok := value.(*subscriber)
 		if !ok {
 			s.logger.Error("error casting value to subscriber", "value", value)
-			return false
+			return true
 		}
-		if err := sub.stream.Send(&pb.ReceiveResponse{Message: msg}); err != nil {
-			s.logger.Error("error sending message to client", "clientId", id, "err", err)
-			sub.finishedChannel <- struct{}{}
-			s.subscribers.Delete(key)
-			return false
+		if !sub.enqueue(msg) {
+			s.droppedMessages.Add(1)
+			s.metrics.messagesDropped.WithLabelValues(rm.name, string(sub.policy)).Inc()
+			s.logger.Debug("subscriber queue overflow", "clientId", sub.clientId, "sessionId", sub.sessionId, "room", rm.name, "policy", sub.policy, "dropped", sub.dropped.Load())
 		}
 		return true
 	})
 }
 
 func (s *ChatServerCmd) Send(ctx context.Context, request *pb.SendRequest) (*pb.SendResponse, error) {
-	s.logger.Info("received message", "message", request.Message)
-	s.messagesChannel <- request.Message
-	return &pb.SendResponse{Status: 0}, nil
+	author := userFromContext(ctx)
+	cm, err := envelopeFromRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolveAttachments(cm); err != nil {
+		return nil, err
+	}
+	s.logger.Info("received message", "room", request.Room, "recipient", request.Recipient, "author", author, "contentType", cm.ContentType, "message", describe(cm))
+	cm.Version = envelopeVersion
+	cm.Author = author
+	cm.Timestamp = timestamppb.Now()
+	msg := &pb.ReceiveResponse{ChatMessage: cm, IdempotencyKey: request.IdempotencyKey}
+
+	var rm *room
+	metricsRoom := directMetricsRoom
+	if request.Recipient != "" {
+		if request.Room != "" {
+			return nil, status.Error(codes.InvalidArgument, "a direct message can't be sent to a room")
+		}
+		rm, err = s.conversation(author, request.Recipient)
+		if err != nil {
+			return nil, err
+		}
+		cm.Recipient = request.Recipient
+	} else {
+		rm, err = s.rooms.Get(request.Room)
+		if err != nil {
+			return nil, err
+		}
+		metricsRoom = rm.name
+	}
+	if cm.ParentId != 0 {
+		parent, err := s.message(rm, cm.ParentId)
+		if err != nil {
+			return nil, err
+		}
+		// replying to a reply continues its thread
+		if parent.ParentId != 0 {
+			cm.ParentId = parent.ParentId
+		}
+	}
+	if request.Recipient == "" {
+		rm.presence.active(author, time.Now())
+		// sending a message ends typing it
+		for _, member := range rm.typing.stopUser(author) {
+			s.signal(rm, member, typingEvent(rm.name, member, false))
+		}
+	}
+
+	s.shutdownMu.RLock()
+	defer s.shutdownMu.RUnlock()
+	if s.shuttingDown {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	duplicate, err := s.fanout.Store(ctx, rm, msg)
+	if err != nil {
+		s.logger.Error("failed to append message to log", "room", rm.name, "err", err)
+		s.metrics.sendFailures.WithLabelValues("append").Inc()
+		return nil, err
+	}
+	result := pb.SendStatus_SEND_STATUS_STORED
+	if duplicate {
+		s.logger.Info("ignored duplicate message", "room", rm.name, "id", msg.Id, "idempotencyKey", request.IdempotencyKey)
+		result = pb.SendStatus_SEND_STATUS_DUPLICATE
+	} else {
+		s.metrics.messagesReceived.WithLabelValues(metricsRoom).Inc()
+	}
+	return &pb.SendResponse{Id: msg.Id, Duplicate: duplicate, Result: result}, nil
+}
+
+// conversation returns the direct conversation between a user and a peer, who has to be a known user. Without
+// authentication everyone is the same anonymous user, so there's nobody to talk to directly.
+func (s *ChatServerCmd) conversation(user, peer string) (*room, error) {
+	if s.auth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "direct messages need authentication to be enabled on this server")
+	}
+	if _, ok := s.auth.users.hash(peer); !ok {
+		return nil, status.Errorf(codes.NotFound, "user %q does not exist", peer)
+	}
+	rm, err := s.directs.Get(user, peer)
+	if err != nil {
+		s.logger.Error("failed to open direct conversation", "user", user, "peer", peer, "err", err)
+		return nil, status.Error(codes.Internal, "failed to open direct conversation")
+	}
+	return rm, nil
+}
+
+// roomOrConversation returns the direct conversation of the caller with peer if it's set, the room otherwise.
+func (s *ChatServerCmd) roomOrConversation(ctx context.Context, room, peer string) (*room, error) {
+	if peer == "" {
+		return s.rooms.Get(room)
+	}
+	if room != "" {
+		return nil, status.Error(codes.InvalidArgument, "either a room or a peer can be given, not both")
+	}
+	return s.conversation(userFromContext(ctx), peer)
 }
 
 func (s *ChatServerCmd) Receive(request *pb.ReceiveRequest, server pb.ChatServer_ReceiveServer) error {
-	s.logger.Debug("received subscription request", "clientId", request.ClientId)
-	f := make(chan struct{})
-	s.subscribers.Store(request.ClientId, subscriber{stream: server, finishedChannel: f})
+	var heartbeat func(room string) error
+	if request.Heartbeats {
+		heartbeat = func(room string) error {
+			return server.Send(heartbeatEvent(room, s.HeartbeatInterval))
+		}
+	}
+	return s.deliver(server.Context(), request, server, server.Send, heartbeat, nil)
+}
+
+// deliver runs a subscription to a room: it joins the room, replays the log after the last id the client has seen and
+// then passes new messages to send until the stream ends. Streams with a heartbeat func get one every heartbeat
+// interval, so both ends can tell a quiet room from a dead stream. Chat streams pass a flow, which gates sending and
+// runs their own work on the same goroutine, Receive streams don't.
+func (s *ChatServerCmd) deliver(ctx context.Context, request *pb.ReceiveRequest, stream grpc.ServerStream, send func(*pb.ReceiveResponse) error, heartbeat func(room string) error, f *flow) error {
+	s.logger.Debug("received subscription request", "clientId", request.ClientId, "user", userFromContext(ctx), "room", request.Room)
+	rm, err := s.rooms.Get(request.Room)
+	if err != nil {
+		return err
+	}
+
+	user := userFromContext(ctx)
+	displayName := request.DisplayName
+	if displayName == "" {
+		displayName = user
+	}
+
+	// subscribe before replaying the log, so no message falls in between, duplicates are skipped by id below
+	sub, err := newSubscriber(request.ClientId, memberKey{user: user, displayName: displayName}, s.QueueSize, overflowPolicy(s.OverflowPolicy))
+	if err != nil {
+		s.logger.Error("failed to create subscriber", "err", err)
+		return status.Error(codes.Internal, "failed to create session")
+	}
+	sub.heartbeats = heartbeat != nil && s.HeartbeatInterval > 0
+	rm.subscribers.Store(sub.sessionId, sub)
+	s.inboxes.add(sub)
+	defer func() {
+		rm.subscribers.CompareAndDelete(sub.sessionId, sub)
+		s.inboxes.remove(sub)
+		if dropped := sub.dropped.Load(); dropped > 0 {
+			s.logger.Info("subscriber dropped messages", "clientId", request.ClientId, "sessionId", sub.sessionId, "room", rm.name, "dropped", dropped)
+		}
+	}()
+	if sessionPolicy(s.SessionPolicy) == sessionReplace {
+		s.replaceSessions(rm, sub)
+	}
+
+	// let the client know it's subscribed and under which session, even if there's nothing to send yet
+	if err := stream.SendHeader(metadata.Pairs(sessionIdHeader, sub.sessionId)); err != nil {
+		return err
+	}
+
+	// tell the room who joined, only the first stream of a member counts
+	if rm.presence.join(user, displayName, time.Now()) {
+		s.logger.Info("member joined", "room", rm.name, "user", user, "displayName", displayName)
+		s.announce(rm, membershipEvent(rm.name, pb.MembershipEvent_KIND_JOIN, user, displayName))
+	}
+	defer func() {
+		if rm.presence.leave(user, displayName) {
+			s.logger.Info("member left", "room", rm.name, "user", user, "displayName", displayName)
+			s.announce(rm, membershipEvent(rm.name, pb.MembershipEvent_KIND_LEAVE, user, displayName))
+		}
+	}()
+
+	lastId := request.LastId
+	err = rm.replay(request.LastId, func(msg *pb.ReceiveResponse) error {
+		if err := f.wait(ctx); err != nil {
+			return err
+		}
+		if err := send(msg); err != nil {
+			return fmt.Errorf("failed to send message %d: %w", msg.Id, err)
+		}
+		sub.sent()
+		f.spend()
+		lastId = msg.Id
+		return nil
+	})
+	if err != nil && ctx.Err() != nil {
+		s.logger.Debug("client disconnected", "clientId", request.ClientId)
+		return nil
+	}
+	if err != nil {
+		s.logger.Error("failed to replay message log", "clientId", request.ClientId, "room", rm.name, "err", err)
+		return err
+	}
+	s.logger.Debug("replayed message log", "clientId", request.ClientId, "sessionId", sub.sessionId, "room", rm.name, "from", request.LastId, "to", lastId)
 
+	var heartbeats <-chan time.Time
+	if sub.heartbeats {
+		ticker := time.NewTicker(s.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
 	for {
+		// without credit messages wait in the queue, where the overflow policy applies as for any slow subscriber
+		queue, signals := sub.queue, sub.signals
+		if !f.open() {
+			queue, signals = nil, nil
+		}
 		select {
-		case <-f:
-			s.logger.Debug("closing stream for client", "clientId", request.ClientId)
-			return nil
-		case <-server.Context().Done():
+		case msg := <-queue:
+			inRoom := msg.Room == rm.name
+			if inRoom && msg.Id != 0 && msg.Id <= lastId {
+				// already delivered while replaying the log
+				continue
+			}
+			if err := send(msg); err != nil {
+				s.logger.Error("error sending message to client", "clientId", request.ClientId, "err", err)
+				s.metrics.sendFailures.WithLabelValues("stream").Inc()
+				return err
+			}
+			sub.sent()
+			f.spend()
+			if inRoom && msg.Id != 0 {
+				lastId = msg.Id
+			}
+		case msg := <-signals:
+			if err := send(msg); err != nil {
+				s.logger.Error("error sending event to client", "clientId", request.ClientId, "err", err)
+				return err
+			}
+			sub.sent()
+			f.spend()
+		case <-heartbeats:
+			// heartbeats don't need credit, they're what shows the stream is still alive
+			if err := heartbeat(rm.name); err != nil {
+				s.logger.Debug("error sending heartbeat to client", "clientId", request.ClientId, "err", err)
+				return err
+			}
+			sub.sent()
+		case work := <-f.control():
+			if err := work(); err != nil {
+				return err
+			}
+		case <-s.shutdownChannel:
+			s.logger.Debug("ending stream, server is shutting down", "clientId", request.ClientId)
+			return s.endStream(send, rm, sub, lastId)
+		case <-sub.finishedChannel:
+			s.logger.Warn("disconnecting client", "clientId", request.ClientId, "sessionId", sub.sessionId, "room", rm.name, "reason", sub.err)
+			if sub.farewell != nil {
+				if err := send(sub.farewell); err != nil {
+					return err
+				}
+			}
+			return sub.err
+		case <-ctx.Done():
 			s.logger.Debug("client disconnected", "clientId", request.ClientId)
-			s.subscribers.Delete(request.ClientId)
 			return nil
 		}
 	}
 }
+
+// endStream sends the messages still queued for a subscriber followed by a shutdown event.
+func (s *ChatServerCmd) endStream(send func(*pb.ReceiveResponse) error, rm *room, sub *subscriber, lastId int32) error {
+	for {
+		select {
+		case msg := <-sub.queue:
+			// direct messages have ids of their conversation
+			inRoom := msg.Room == rm.name
+			if inRoom && msg.Id != 0 && msg.Id <= lastId {
+				continue
+			}
+			if err := send(msg); err != nil {
+				return err
+			}
+			if inRoom && msg.Id != 0 {
+				lastId = msg.Id
+			}
+		default:
+			return send(systemEvent(rm.name, pb.SystemEvent_KIND_SHUTDOWN, "server shutting down"))
+		}
+	}
+}
+
+func (s *ChatServerCmd) ListRooms(ctx context.Context, request *pb.ListRoomsRequest) (*pb.ListRoomsResponse, error) {
+	resp := &pb.ListRoomsResponse{}
+	for _, rm := range s.rooms.List() {
+		resp.Rooms = append(resp.Rooms, rm.info())
+	}
+	return resp, nil
+}
+
+func (s *ChatServerCmd) CreateRoom(ctx context.Context, request *pb.CreateRoomRequest) (*pb.CreateRoomResponse, error) {
+	rm, err := s.rooms.Create(request.Name)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("created room", "room", rm.name)
+	s.fanout.RoomChanged(ctx, rm.name, false)
+	return &pb.CreateRoomResponse{Room: rm.info()}, nil
+}
+
+func (s *ChatServerCmd) DeleteRoom(ctx context.Context, request *pb.DeleteRoomRequest) (*pb.DeleteRoomResponse, error) {
+	// the history of the room goes with it, so only admins may do it once users are told apart
+	if user := userFromContext(ctx); s.auth != nil && !s.isAdmin(user) {
+		return nil, status.Errorf(codes.PermissionDenied, "only admins may delete rooms, %s isn't one", user)
+	}
+	if err := s.rooms.Delete(request.Name); err != nil {
+		return nil, err
+	}
+	s.logger.Info("deleted room", "room", request.Name)
+	s.fanout.RoomChanged(ctx, request.Name, true)
+	return &pb.DeleteRoomResponse{}, nil
+}
+
+func (s *ChatServerCmd) History(ctx context.Context, request *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	rm, err := s.roomOrConversation(ctx, request.Room, request.Peer)
+	if err != nil {
+		return nil, err
+	}
+	q, err := newHistoryQuery(request)
+	if err != nil {
+		return nil, err
+	}
+	messages, next, err := rm.history(q)
+	if err != nil {
+		s.logger.Error("failed to read message log", "room", rm.name, "err", err)
+		return nil, status.Error(codes.Internal, "failed to read message log")
+	}
+	return &pb.HistoryResponse{Messages: messages, NextCursor: next}, nil
+}
+
+func (s *ChatServerCmd) Search(ctx context.Context, request *pb.SearchRequest) (*pb.SearchResponse, error) {
+	clauses, err := parseSearchQuery(request.Query)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(request.Limit)
+	switch {
+	case limit < 0:
+		return nil, status.Error(codes.InvalidArgument, "limit can't be negative")
+	case limit == 0:
+		limit = defaultSearchLimit
+	case limit > maxSearchLimit:
+		limit = maxSearchLimit
+	}
+	var since, until time.Time
+	if request.Since != nil {
+		since = request.Since.AsTime()
+	}
+	if request.Until != nil {
+		until = request.Until.AsTime()
+	}
+
+	rooms := s.rooms.List()
+	if request.Room != "" {
+		rm, err := s.rooms.Get(request.Room)
+		if err != nil {
+			return nil, err
+		}
+		rooms = []*room{rm}
+	}
+
+	// pick the newest matches of all rooms, ids only tell the order within a room
+	type match struct {
+		room *room
+		id   int32
+		at   time.Time
+	}
+	var matches []match
+	for _, rm := range rooms {
+		for _, hit := range rm.index.search(clauses, request.Author, since, until) {
+			matches = append(matches, match{room: rm, id: hit.id, at: hit.at})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].at.After(matches[j].at) })
+	resp := &pb.SearchResponse{Total: int32(len(matches))}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	ids := map[*room][]int32{}
+	for _, m := range matches {
+		ids[m.room] = append(ids[m.room], m.id)
+	}
+	found := map[*room]map[int32]*pb.ChatMessage{}
+	for rm, roomIds := range ids {
+		sort.Slice(roomIds, func(i, j int) bool { return roomIds[i] < roomIds[j] })
+		messages, err := rm.messages(roomIds)
+		if err != nil {
+			s.logger.Error("failed to read message log", "room", rm.name, "err", err)
+			return nil, status.Error(codes.Internal, "failed to read message log")
+		}
+		found[rm] = map[int32]*pb.ChatMessage{}
+		for _, cm := range messages {
+			found[rm][cm.Id] = cm
+		}
+	}
+	for _, m := range matches {
+		cm, ok := found[m.room][m.id]
+		if !ok {
+			continue
+		}
+		resp.Results = append(resp.Results, &pb.SearchResult{Message: cm, Highlights: highlights(clauses, cm.GetText().GetText())})
+	}
+	return resp, nil
+}
+
+func (s *ChatServerCmd) ListMembers(ctx context.Context, request *pb.ListMembersRequest) (*pb.ListMembersResponse, error) {
+	rm, err := s.rooms.Get(request.Room)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListMembersResponse{Members: rm.presence.list(time.Now())}, nil
+}
+
+func (s *ChatServerCmd) SetTyping(ctx context.Context, request *pb.SetTypingRequest) (*pb.SetTypingResponse, error) {
+	rm, err := s.rooms.Get(request.Room)
+	if err != nil {
+		return nil, err
+	}
+	member := memberKey{user: userFromContext(ctx), displayName: request.DisplayName}
+	if member.displayName == "" {
+		member.displayName = member.user
+	}
+	if rm.typing.set(member, request.Typing, time.Now().Add(s.TypingTimeout)) {
+		s.signal(rm, member, typingEvent(rm.name, member, request.Typing))
+	}
+	return &pb.SetTypingResponse{ExpiresIn: durationpb.New(s.TypingTimeout)}, nil
+}
+
+func (s *ChatServerCmd) Login(ctx context.Context, request *pb.LoginRequest) (*pb.LoginResponse, error) {
+	if s.auth == nil {
+		return nil, status.Error(codes.FailedPrecondition, "authentication is disabled on this server")
+	}
+	if !s.auth.checkPassword(request.Username, request.Password) {
+		s.logger.Warn("failed login attempt", "user", request.Username)
+		return nil, status.Error(codes.Unauthenticated, "invalid username or password")
+	}
+	token, expiresAt := s.auth.issueToken(request.Username)
+	s.logger.Info("user logged in", "user", request.Username)
+	return &pb.LoginResponse{Token: token, ExpiresAt: timestamppb.New(expiresAt)}, nil
+}
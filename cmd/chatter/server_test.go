@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestServer returns a server storing its rooms in dir, set up like Run does without listening anywhere.
+func newTestServer(t *testing.T, dir string) *ChatServerCmd {
+	t.Helper()
+	s := &ChatServerCmd{
+		QueueSize:       100,
+		OverflowPolicy:  string(overflowDropOldest),
+		SessionPolicy:   string(sessionConcurrent),
+		DedupWindow:     time.Hour,
+		logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		messagesChannel: make(chan broadcast, 10),
+		shutdownChannel: make(chan struct{}),
+	}
+	s.metrics = newServerMetrics(s)
+	options := roomOptions{segmentSize: 1 << 20, syncMode: walSyncNever, syncInterval: time.Second, dedupWindow: time.Hour}
+	var err error
+	if s.rooms, err = openRoomRegistry(filepath.Join(dir, "rooms"), options); err != nil {
+		t.Fatal(err)
+	}
+	if s.directs, err = openConversations(filepath.Join(dir, "direct"), options); err != nil {
+		t.Fatal(err)
+	}
+	s.inboxes = newInboxes()
+	s.fanout = localFanout{messagesChannel: s.messagesChannel}
+	return s
+}
+
+// testServer is a server running in process on a bufconn listener, with a client connected to it.
+type testServer struct {
+	s      *ChatServerCmd
+	srv    *grpc.Server
+	conn   *grpc.ClientConn
+	client pb.ChatServerClient
+
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// serveTest runs s on lis, broadcasting its messages like Run does, and runs background work if it's set, until the
+// test ends. dial connects the client to lis.
+func serveTest(t *testing.T, s *ChatServerCmd, lis *bufconn.Listener, dial func(context.Context, string) (net.Conn, error), register func(*grpc.Server), background func(ctx context.Context)) *testServer {
+	t.Helper()
+	var serverOptions []grpc.ServerOption
+	if s.auth != nil {
+		serverOptions = append(serverOptions,
+			grpc.ChainUnaryInterceptor(s.auth.unaryInterceptor),
+			grpc.ChainStreamInterceptor(s.auth.streamInterceptor),
+		)
+	}
+	ts := &testServer{s: s, srv: grpc.NewServer(serverOptions...)}
+	pb.RegisterChatServerServer(ts.srv, s)
+	if register != nil {
+		register(ts.srv)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.cancel = cancel
+	ts.running.Add(2)
+	go func() {
+		defer ts.running.Done()
+		_ = ts.srv.Serve(lis)
+	}()
+	go func() {
+		defer ts.running.Done()
+		for {
+			select {
+			case b := <-s.messagesChannel:
+				s.dispatch(b)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if background != nil {
+		ts.running.Add(1)
+		go func() {
+			defer ts.running.Done()
+			background(ctx)
+		}()
+	}
+
+	var err error
+	ts.conn, err = grpc.Dial("bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.client = pb.NewChatServerClient(ts.conn)
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+// startTestServer runs a server on a listener of its own.
+func startTestServer(t *testing.T, s *ChatServerCmd) *testServer {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	return serveTest(t, s, lis, func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }, nil, nil)
+}
+
+// stop stops the server and closes its rooms, it's safe to call more than once.
+func (ts *testServer) stop() {
+	if ts.cancel == nil {
+		return
+	}
+	ts.s.shutdownMu.Lock()
+	ts.s.shuttingDown = true
+	ts.s.shutdownMu.Unlock()
+	ts.conn.Close()
+	ts.srv.Stop()
+	ts.cancel()
+	ts.running.Wait()
+	ts.s.rooms.Close()
+	ts.s.directs.Close()
+	ts.cancel = nil
+}
+
+// asUser adds basic credentials of a user created by newTestAuthenticator to the calls made with ctx.
+func asUser(ctx context.Context, user string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, authorizationHeader, "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":pw")))
+}
+
+// receiveUntil collects the stored messages and direct messages arriving on a stream until the message with the given
+// text.
+func receiveUntil(t *testing.T, stream pb.ChatServer_ReceiveClient, text string) []*pb.ReceiveResponse {
+	t.Helper()
+	var received []*pb.ReceiveResponse
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("stream ended before %q arrived: %v", text, err)
+		}
+		// direct messages come without the id of a room, only events are skipped
+		if msg.Id == 0 && msg.ChatMessage.GetRecipient() == "" {
+			continue
+		}
+		received = append(received, msg)
+		if msg.ChatMessage.GetText().GetText() == text {
+			return received
+		}
+	}
+}
+
+func TestDirectMessagesReachEveryClientOnce(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.auth, _ = newTestAuthenticator(t, time.Hour)
+	if _, err := s.rooms.Create("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// alice has one client receiving two rooms, and another one receiving one of them
+	type stream struct {
+		client, room string
+		pb.ChatServer_ReceiveClient
+	}
+	var streams []stream
+	for _, sub := range []struct{ client, room string }{{"laptop", "general"}, {"laptop", "lobby"}, {"phone", "general"}} {
+		receive, err := ts.client.Receive(asUser(ctx, "alice"), &pb.ReceiveRequest{Room: sub.room, ClientId: sub.client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := receive.Header(); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream{sub.client, sub.room, receive})
+	}
+
+	if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Recipient: "alice", Message: "psst"}); err != nil {
+		t.Fatal(err)
+	}
+	// every stream gets the messages of its room after the direct message, anything else arrived by then
+	for _, room := range []string{"general", "lobby"} {
+		if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Room: room, Message: "done " + room}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	direct := map[string]int{}
+	for _, st := range streams {
+		for _, msg := range receiveUntil(t, st, "done "+st.room) {
+			if msg.ChatMessage.Recipient != "" {
+				if msg.Room != conversationName("alice", "bob") {
+					t.Errorf("direct message arrived with room %q", msg.Room)
+				}
+				direct[st.client]++
+			}
+		}
+	}
+	if direct["laptop"] != 1 || direct["phone"] != 1 {
+		t.Fatalf("direct message arrived %d times on the laptop and %d times on the phone, want once on each", direct["laptop"], direct["phone"])
+	}
+}
+
+func TestDirectMessagesKeepRoomPositions(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	s.auth, _ = newTestAuthenticator(t, time.Hour)
+	if _, err := s.rooms.Create("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the lobby is far ahead of general
+	for i := 1; i <= 5; i++ {
+		if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Room: "lobby", Message: fmt.Sprintf("lobby %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	general, err := ts.client.Receive(asUser(ctx, "alice"), &pb.ReceiveRequest{Room: "general", ClientId: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobby, err := ts.client.Receive(asUser(ctx, "alice"), &pb.ReceiveRequest{Room: "lobby", ClientId: "laptop", LastId: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range []pb.ChatServer_ReceiveClient{general, lobby} {
+		if _, err := stream.Header(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// direct messages with ids beyond those of general arrive on one of the streams first
+	for i := 1; i <= 3; i++ {
+		if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Recipient: "alice", Message: fmt.Sprintf("direct %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Room: "general", Message: fmt.Sprintf("general %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Room: "lobby", Message: "lobby 6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int32
+	for _, msg := range receiveUntil(t, general, "general 2") {
+		if msg.Room == "general" {
+			ids = append(ids, msg.Id)
+		}
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("general stream got messages %v, want [1 2]", ids)
+	}
+	ids = nil
+	for _, msg := range receiveUntil(t, lobby, "lobby 6") {
+		if msg.Room == "lobby" {
+			ids = append(ids, msg.Id)
+		}
+	}
+	if len(ids) != 1 || ids[0] != 6 {
+		t.Fatalf("lobby stream got messages %v, want [6]", ids)
+	}
+}
+
+func TestSessionPolicies(t *testing.T) {
+	for _, policy := range []sessionPolicy{sessionConcurrent, sessionReplace} {
+		t.Run(string(policy), func(t *testing.T) {
+			s := newTestServer(t, t.TempDir())
+			s.auth, _ = newTestAuthenticator(t, time.Hour)
+			s.SessionPolicy = string(policy)
+			ts := startTestServer(t, s)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// alice opens the same client twice, bob is there too
+			subscribe := func(user string) (pb.ChatServer_ReceiveClient, string) {
+				t.Helper()
+				stream, err := ts.client.Receive(asUser(ctx, user), &pb.ReceiveRequest{ClientId: "laptop"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				header, err := stream.Header()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := header.Get(sessionIdHeader)
+				if len(ids) != 1 || ids[0] == "" {
+					t.Fatalf("stream of %s came with session ids %v", user, ids)
+				}
+				return stream, ids[0]
+			}
+			bob, _ := subscribe("bob")
+			older, olderId := subscribe("alice")
+			newer, newerId := subscribe("alice")
+			if olderId == newerId {
+				t.Fatalf("both sessions have the id %s", olderId)
+			}
+
+			if _, err := ts.client.Send(asUser(ctx, "bob"), &pb.SendRequest{Message: "hello"}); err != nil {
+				t.Fatal(err)
+			}
+			receiveUntil(t, newer, "hello")
+			receiveUntil(t, bob, "hello")
+			if policy == sessionConcurrent {
+				receiveUntil(t, older, "hello")
+				return
+			}
+
+			// the older session is told it was replaced and ends, without getting anything sent after that
+			replaced := false
+			for {
+				msg, err := older.Recv()
+				if err != nil {
+					if status.Code(err) != codes.FailedPrecondition {
+						t.Fatalf("older session ended with %v, want FailedPrecondition", err)
+					}
+					break
+				}
+				if msg.ChatMessage.GetSystem().GetKind() == pb.SystemEvent_KIND_REPLACED {
+					replaced = true
+				}
+				if msg.ChatMessage.GetText().GetText() == "hello" {
+					t.Fatal("older session got a message sent after it was replaced")
+				}
+			}
+			if !replaced {
+				t.Fatal("older session ended without being told it was replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultStateDir returns the directory client side state is kept in, following the XDG base directory spec.
+func defaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "chatter")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "chatter")
+	}
+	return filepath.Join(home, ".local", "state", "chatter")
+}
+
+// writeFileAtomic replaces the contents of path, so a crash never leaves a half written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// migrateLastId moves the file the last id was kept in by earlier versions to path, unless there's one already.
+func migrateLastId(legacy, path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(legacy); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(legacy, path)
+}
+
+// readLastId reads a message id persisted with writeLastId. A missing file means nothing has been seen yet.
+func readLastId(path string) (int32, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse last id: %w", err)
+	}
+	return int32(id), nil
+}
+
+func writeLastId(path string, id int32) error {
+	return writeFileAtomic(path, []byte(strconv.FormatInt(int64(id), 10)+"\n"))
+}
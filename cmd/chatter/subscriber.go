@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"github.com/oklog/ulid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// overflowPolicy decides what happens when a subscriber's outbound queue is full.
+type overflowPolicy string
+
+const (
+	overflowDropOldest overflowPolicy = "drop-oldest" // discard the oldest queued message to make room
+	overflowDropNewest overflowPolicy = "drop-newest" // discard the message that doesn't fit
+	overflowDisconnect overflowPolicy = "disconnect"  // close the subscriber's stream
+)
+
+// sessionIdHeader is the response header telling a client the id of its session.
+const sessionIdHeader = "session-id"
+
+// signalQueueSize is the number of ephemeral events buffered for every subscriber, more are dropped.
+const signalQueueSize = 16
+
+// sessionPolicy decides what happens when a user opens another stream in a room it's already receiving.
+type sessionPolicy string
+
+const (
+	sessionConcurrent sessionPolicy = "concurrent" // keep all of them, e.g. for a laptop and a phone
+	sessionReplace    sessionPolicy = "replace"    // end the older ones with a replaced event
+)
+
+// subscriber is a single Receive stream. The broadcast goroutine only ever puts messages on its queue, the Receive
+// handler drains the queue and does the actual, possibly slow, sending.
+type subscriber struct {
+	sessionId       string // generated by the server, unlike the client id it's unique
+	clientId        string
+	member          memberKey
+	queue           chan *pb.ReceiveResponse
+	signals         chan *pb.ReceiveResponse // ephemeral events, which bypass the queue and its overflow policy
+	policy          overflowPolicy
+	finishedChannel chan struct{} // closed when the subscriber has to be disconnected, err says why
+	finishOnce      sync.Once
+	err             error
+	farewell        *pb.ReceiveResponse // sent before the stream ends with err, if set
+	dropped         atomic.Uint64
+	heartbeats      bool         // whether the stream gets heartbeats, only then silence means it's stuck
+	lastSent        atomic.Int64 // unix nanoseconds of the last message or heartbeat that made it to the stream
+}
+
+func newSubscriber(clientId string, member memberKey, queueSize int, policy overflowPolicy) (*subscriber, error) {
+	u, err := ulid.New(ulid.Now(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a session id: %w", err)
+	}
+	sub := &subscriber{
+		sessionId:       u.String(),
+		clientId:        clientId,
+		member:          member,
+		queue:           make(chan *pb.ReceiveResponse, queueSize),
+		signals:         make(chan *pb.ReceiveResponse, signalQueueSize),
+		policy:          policy,
+		finishedChannel: make(chan struct{}),
+	}
+	sub.lastSent.Store(time.Now().UnixNano())
+	return sub, nil
+}
+
+// enqueue puts a message on the subscriber's queue without blocking. It returns false if the message, or an older
+// one, had to be dropped.
+func (sub *subscriber) enqueue(msg *pb.ReceiveResponse) bool {
+	select {
+	case sub.queue <- msg:
+		return true
+	default:
+	}
+
+	switch sub.policy {
+	case overflowDropOldest:
+		for {
+			select {
+			case <-sub.queue:
+				sub.dropped.Add(1)
+			default:
+			}
+			select {
+			case sub.queue <- msg:
+				return false
+			default:
+			}
+		}
+	case overflowDisconnect:
+		sub.dropped.Add(1)
+		sub.finish(status.Error(codes.ResourceExhausted, "subscriber queue overflow: client is too slow to keep up with messages"))
+		return false
+	default:
+		sub.dropped.Add(1)
+		return false
+	}
+}
+
+// signal hands an ephemeral event to the subscriber without blocking, it's dropped if the subscriber is behind.
+func (sub *subscriber) signal(msg *pb.ReceiveResponse) {
+	select {
+	case sub.signals <- msg:
+	default:
+	}
+}
+
+// finish disconnects the subscriber, the error is returned from its Receive stream.
+func (sub *subscriber) finish(err error) {
+	sub.finishWith(nil, err)
+}
+
+// finishWith disconnects the subscriber after sending it a last event telling why.
+func (sub *subscriber) finishWith(farewell *pb.ReceiveResponse, err error) {
+	sub.finishOnce.Do(func() {
+		sub.farewell = farewell
+		sub.err = err
+		close(sub.finishedChannel)
+	})
+}
+
+// sent records that a message or heartbeat made it to the stream.
+func (sub *subscriber) sent() {
+	sub.lastSent.Store(time.Now().UnixNano())
+}
+
+// missedHeartbeats tells whether nothing made it to a stream getting heartbeats for longer than limit, which means
+// sending to it got stuck.
+func (sub *subscriber) missedHeartbeats(now time.Time, limit time.Duration) bool {
+	return sub.heartbeats && now.Sub(time.Unix(0, sub.lastSent.Load())) > limit
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// drain returns the ids of the messages on a subscriber's queue.
+func drain(sub *subscriber) []int32 {
+	var ids []int32
+	for {
+		select {
+		case msg := <-sub.queue:
+			ids = append(ids, msg.Id)
+		default:
+			return ids
+		}
+	}
+}
+
+func finished(sub *subscriber) bool {
+	select {
+	case <-sub.finishedChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestEnqueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy   overflowPolicy
+		accepted []bool
+		queued   []int32
+		finished bool
+	}{
+		{policy: overflowDropOldest, accepted: []bool{true, true, true, false, false}, queued: []int32{3, 4, 5}},
+		{policy: overflowDropNewest, accepted: []bool{true, true, true, false, false}, queued: []int32{1, 2, 3}},
+		{policy: overflowDisconnect, accepted: []bool{true, true, true, false, false}, queued: []int32{1, 2, 3}, finished: true},
+	} {
+		sub, err := newSubscriber("client", memberKey{user: "alice"}, 3, tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range tc.accepted {
+			if got := sub.enqueue(&pb.ReceiveResponse{Id: int32(i + 1)}); got != tc.accepted[i] {
+				t.Errorf("%s: enqueueing message %d returned %v, want %v", tc.policy, i+1, got, tc.accepted[i])
+			}
+			// a full queue alone doesn't end the stream
+			if i < 3 && finished(sub) {
+				t.Fatalf("%s: finished after %d messages", tc.policy, i+1)
+			}
+		}
+		if got := drain(sub); !reflect.DeepEqual(got, tc.queued) {
+			t.Errorf("%s: queue has %v, want %v", tc.policy, got, tc.queued)
+		}
+		if dropped := sub.dropped.Load(); dropped != 2 {
+			t.Errorf("%s: dropped %d messages, want 2", tc.policy, dropped)
+		}
+		if finished(sub) != tc.finished {
+			t.Errorf("%s: finished is %v, want %v", tc.policy, finished(sub), tc.finished)
+		}
+		if tc.finished && status.Code(sub.err) != codes.ResourceExhausted {
+			t.Errorf("%s: finished with %v, want ResourceExhausted", tc.policy, sub.err)
+		}
+	}
+}
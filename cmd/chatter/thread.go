@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// messageThreads keeps track of which messages of a room reply to which root.
+type messageThreads struct {
+	mu      sync.RWMutex
+	replies map[int32][]int32 // root id to the ids of its replies, ascending
+	roots   map[int32]int32   // reply id to root id
+}
+
+func newMessageThreads() *messageThreads {
+	return &messageThreads{replies: map[int32][]int32{}, roots: map[int32]int32{}}
+}
+
+// add records a reply, replies have to be added in id order.
+func (t *messageThreads) add(root, id int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replies[root] = append(t.replies[root], id)
+	t.roots[id] = root
+}
+
+// remove forgets a deleted reply.
+func (t *messageThreads) remove(id int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	root, ok := t.roots[id]
+	if !ok {
+		return
+	}
+	delete(t.roots, id)
+	replies := t.replies[root]
+	for i, reply := range replies {
+		if reply == id {
+			replies = append(replies[:i], replies[i+1:]...)
+			break
+		}
+	}
+	if len(replies) == 0 {
+		delete(t.replies, root)
+		return
+	}
+	t.replies[root] = replies
+}
+
+func (t *messageThreads) count(root int32) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.replies[root])
+}
+
+// list returns the ids of the replies to a root, ascending.
+func (t *messageThreads) list(root int32) []int32 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]int32(nil), t.replies[root]...)
+}
+
+func (s *ChatServerCmd) GetThread(ctx context.Context, request *pb.GetThreadRequest) (*pb.GetThreadResponse, error) {
+	rm, err := s.roomOrConversation(ctx, request.Room, request.Peer)
+	if err != nil {
+		return nil, err
+	}
+	if request.MessageId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid message id")
+	}
+	messages, err := rm.messages([]int32{request.MessageId})
+	if err != nil {
+		s.logger.Error("failed to read message log", "room", rm.name, "err", err)
+		return nil, status.Error(codes.Internal, "failed to read message log")
+	}
+	if len(messages) == 0 {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", request.MessageId)
+	}
+	root := messages[0].Id
+	if messages[0].ParentId != 0 {
+		root = messages[0].ParentId
+	}
+
+	messages, err = rm.messages(append([]int32{root}, rm.threads.list(root)...))
+	if err != nil {
+		s.logger.Error("failed to read message log", "room", rm.name, "err", err)
+		return nil, status.Error(codes.Internal, "failed to read message log")
+	}
+	if len(messages) == 0 || messages[0].Id != root {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", root)
+	}
+	return &pb.GetThreadResponse{Root: messages[0], Replies: messages[1:]}, nil
+}
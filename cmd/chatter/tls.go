@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/mwasilew2/chatter/gen"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// certReloader serves a key pair and a CA bundle from disk and picks up changes to the files without a restart. The
+// files are checked lazily, at most once per interval, when a TLS handshake asks for them.
+type certReloader struct {
+	certFile, keyFile, caFile string
+	interval                  time.Duration
+
+	mu         sync.Mutex
+	checkedAt  time.Time
+	modTimes   [3]time.Time
+	cert       *tls.Certificate
+	caPool     *x509.CertPool
+	lastFailed string // error of the last failed reload, so a broken file is reported once rather than on every check
+
+	logger *slog.Logger
+}
+
+func newCertReloader(certFile, keyFile, caFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile, interval: interval, logger: slog.Default().With("component", "certReloader")}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	var modTimes [3]time.Time
+	for i, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", f, err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if modTimes == r.modTimes && (r.cert != nil || r.caPool != nil) {
+		return nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load key pair: %w", err)
+		}
+		cert = &c
+	}
+	var caPool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca file: %w", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca file %s", r.caFile)
+		}
+	}
+	r.cert = cert
+	r.caPool = caPool
+	r.modTimes = modTimes
+	return nil
+}
+
+// current returns the newest key pair and CA bundle. If reloading fails, e.g. because a file is half written, the
+// previous ones are kept.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) >= r.interval {
+		r.checkedAt = time.Now()
+		if err := r.reload(); err != nil {
+			if err.Error() != r.lastFailed {
+				r.logger.Error("failed to reload certificates, keeping the previous ones", "cert", r.certFile, "ca", r.caFile, "err", err)
+			}
+			r.lastFailed = err.Error()
+		} else if r.lastFailed != "" {
+			r.logger.Info("reloaded certificates", "cert", r.certFile, "ca", r.caFile)
+			r.lastFailed = ""
+		}
+	}
+	return r.cert, r.caPool
+}
+
+// serverTLSOptions are the TLS cli options of the server.
+type serverTLSOptions struct {
+	TLSCert           string        `name:"tls-cert" help:"server certificate file, enables TLS" type:"path"`
+	TLSKey            string        `name:"tls-key" help:"server private key file" type:"path"`
+	TLSCA             string        `name:"tls-ca" help:"CA bundle used to verify client certificates" type:"path"`
+	TLSClientAuth     string        `name:"tls-client-auth" help:"client certificate verification: none, verify-if-given or require" enum:"none,verify-if-given,require" default:"none"`
+	TLSReloadInterval time.Duration `name:"tls-reload-interval" help:"how often to check the certificate files for changes" default:"10s"`
+}
+
+func (o serverTLSOptions) serverOption() (grpc.ServerOption, error) {
+	if o.TLSCert == "" {
+		if o.TLSKey != "" || o.TLSCA != "" {
+			return nil, errors.New("--tls-key and --tls-ca require --tls-cert")
+		}
+		return grpc.Creds(insecure.NewCredentials()), nil
+	}
+	if o.TLSKey == "" {
+		return nil, errors.New("--tls-cert requires --tls-key")
+	}
+
+	clientAuth := tls.NoClientCert
+	switch o.TLSClientAuth {
+	case "verify-if-given":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if clientAuth != tls.NoClientCert && o.TLSCA == "" {
+		return nil, fmt.Errorf("--tls-client-auth=%s requires --tls-ca", o.TLSClientAuth)
+	}
+
+	reloader, err := newCertReloader(o.TLSCert, o.TLSKey, o.TLSCA, o.TLSReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, caPool := reloader.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    caPool,
+				ClientAuth:   clientAuth,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}
+	return grpc.Creds(credentials.NewTLS(config)), nil
+}
+
+// clientTLSOptions are the TLS cli options shared by all commands connecting to the server.
+type clientTLSOptions struct {
+	TLS               bool          `name:"tls" help:"connect using TLS, implied by the other --tls options"`
+	TLSCert           string        `name:"tls-cert" help:"client certificate file, for servers requiring mutual TLS" type:"path"`
+	TLSKey            string        `name:"tls-key" help:"client private key file" type:"path"`
+	TLSCA             string        `name:"tls-ca" help:"CA bundle used to verify the server certificate, system roots are used if empty" type:"path"`
+	TLSServerName     string        `name:"tls-server-name" help:"server name to verify the server certificate against, defaults to the host of --addr"`
+	TLSReloadInterval time.Duration `name:"tls-reload-interval" help:"how often to check the certificate files for changes" default:"10s"`
+}
+
+func (o clientTLSOptions) enabled() bool {
+	return o.TLS || o.TLSCert != "" || o.TLSKey != "" || o.TLSCA != "" || o.TLSServerName != ""
+}
+
+func (o clientTLSOptions) dialOption() (grpc.DialOption, error) {
+	if !o.enabled() {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key have to be used together")
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.TLSServerName,
+	}
+	if o.TLSCert != "" || o.TLSCA != "" {
+		reloader, err := newCertReloader(o.TLSCert, o.TLSKey, o.TLSCA, o.TLSReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		if o.TLSCA != "" {
+			// the server certificate is verified against the current CA bundle on every handshake, the config only
+			// takes a fixed pool
+			config.InsecureSkipVerify = true
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				_, caPool := reloader.current()
+				return verifyServerCertificate(rawCerts, caPool, o.TLSServerName)
+			}
+		}
+		if o.TLSCert != "" {
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, _ := reloader.current()
+				return cert, nil
+			}
+		}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// verifyServerCertificate does the verification crypto/tls does for a client, against roots which may change.
+func verifyServerCertificate(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// dial connects to the chat server and authenticates every call made on the connection.
+func dial(addr string, tlsOptions clientTLSOptions, authOptions clientAuthOptions, options ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if tlsOptions.enabled() && tlsOptions.TLSServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if host == "" {
+			// an address like ":8080" means the local machine
+			host = "localhost"
+		}
+		tlsOptions.TLSServerName = host
+	}
+	creds, err := tlsOptions.dialOption()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls options: %w", err)
+	}
+	if authOptions.User == "" && authOptions.Token == "" {
+		return grpc.Dial(addr, append([]grpc.DialOption{creds}, options...)...)
+	}
+	// passwords and tokens are never sent in plaintext
+	if !tlsOptions.enabled() {
+		return nil, errors.New("--user and --token require --tls")
+	}
+	tokenCreds := newTokenCredentials(authOptions)
+	conn, err := grpc.Dial(addr, append([]grpc.DialOption{creds, grpc.WithPerRPCCredentials(tokenCreds)}, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	tokenCreds.pbClient = pb.NewChatServerClient(conn)
+	return conn, nil
+}
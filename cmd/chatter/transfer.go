@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pb "github.com/mwasilew2/chatter/gen"
+)
+
+// uploadFile streams a file to the server's blob store and returns the attachment referring to it.
+func uploadFile(ctx context.Context, pbClient pb.ChatServerClient, path string) (*pb.Attachment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	stream, err := pbClient.UploadAttachment(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload: %w", err)
+	}
+	info := &pb.UploadInfo{Name: filepath.Base(path), Size: fi.Size()}
+	if err := stream.Send(&pb.UploadAttachmentRequest{Part: &pb.UploadAttachmentRequest_Info{Info: info}}); err != nil {
+		return nil, uploadError(stream, err)
+	}
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&pb.UploadAttachmentRequest{Part: &pb.UploadAttachmentRequest_Chunk{Chunk: buf[:n]}}); err != nil {
+				return nil, uploadError(stream, err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload: %w", err)
+	}
+	return resp.Attachment, nil
+}
+
+// uploadError returns the reason the server gave for ending an upload early, Send itself only reports io.EOF then.
+func uploadError(stream pb.ChatServer_UploadAttachmentClient, err error) error {
+	if errors.Is(err, io.EOF) {
+		_, err = stream.CloseAndRecv()
+	}
+	return fmt.Errorf("failed to upload: %w", err)
+}
+
+// downloadFile saves an attachment in dir under the name it was uploaded with, or its id if it has none, and checks
+// that the content matches the id. Existing files are never overwritten.
+func downloadFile(ctx context.Context, pbClient pb.ChatServerClient, id, dir string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pbClient.DownloadAttachment(ctx, &pb.DownloadAttachmentRequest{Id: id})
+	if err != nil {
+		return "", fmt.Errorf("failed to start download: %w", err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("failed to download: %w", err)
+	}
+	info := first.GetInfo()
+	if info == nil {
+		return "", errors.New("failed to download: the server sent no info")
+	}
+	name := id
+	if info.Name != "" {
+		name = filepath.Base(filepath.Clean("/" + info.Name))
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	w := io.MultiWriter(f, hash)
+	for err == nil {
+		var resp *pb.DownloadAttachmentResponse
+		resp, err = stream.Recv()
+		if err == nil {
+			_, err = w.Write(resp.GetChunk())
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		f.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("failed to download: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != id {
+		os.Remove(path)
+		return "", errors.New("downloaded content doesn't match the attachment id")
+	}
+	return path, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	pb "github.com/mwasilew2/chatter/gen"
+	"github.com/rivo/tview"
+)
+
+const tuiHistorySize = 100 // number of input lines remembered for up/down recall
+
+// chatTUI is the full-screen view of the client: a scrollback pane with the messages of the room, a list of the members
+// of the room, an input line and a status bar. All methods are safe to call from any goroutine.
+type chatTUI struct {
+	app      *tview.Application
+	messages *tview.TextView
+	members  *tview.TextView
+	typing   *tview.TextView
+	input    *tview.InputField
+	status   *tview.TextView
+
+	// updates waiting for the event loop, tview's own queue blocks until an update ran, which would deadlock when
+	// called from the event loop itself or after it stopped
+	updates chan func()
+	done    chan struct{}
+
+	// only accessed from the tview event loop
+	history    []string
+	historyPos int
+	draft      string
+	online     map[string]bool
+	typers     map[string]bool
+	statusInfo map[string]string
+}
+
+// newChatTUI creates the window, onSubmit is called with every line entered and onChange whenever the input line
+// changes, both on the event loop.
+func newChatTUI(onSubmit func(line string), onChange func(text string)) *chatTUI {
+	t := &chatTUI{
+		app:        tview.NewApplication(),
+		messages:   tview.NewTextView(),
+		members:    tview.NewTextView(),
+		typing:     tview.NewTextView(),
+		input:      tview.NewInputField(),
+		status:     tview.NewTextView(),
+		updates:    make(chan func(), 256),
+		done:       make(chan struct{}),
+		online:     map[string]bool{},
+		typers:     map[string]bool{},
+		statusInfo: map[string]string{},
+	}
+
+	t.messages.SetDynamicColors(true).SetScrollable(true).SetWordWrap(true).SetMaxLines(10000)
+	t.messages.SetBorder(true).SetTitle(" messages ")
+
+	t.members.SetDynamicColors(true)
+	t.members.SetBorder(true).SetTitle(" members ")
+
+	t.status.SetDynamicColors(true)
+	t.status.SetBackgroundColor(tcell.ColorDarkBlue)
+
+	t.typing.SetDynamicColors(true)
+
+	t.input.SetLabel("> ").SetFieldBackgroundColor(tcell.ColorDefault)
+	t.input.SetChangedFunc(onChange)
+	t.input.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		line := t.input.GetText()
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		t.input.SetText("")
+		t.remember(line)
+		onSubmit(line)
+	})
+	t.input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			t.recall(-1)
+			return nil
+		case tcell.KeyDown:
+			t.recall(1)
+			return nil
+		case tcell.KeyPgUp, tcell.KeyPgDn:
+			// scroll the messages without moving the focus away from the input line
+			t.messages.InputHandler()(event, func(tview.Primitive) {})
+			return nil
+		}
+		return event
+	})
+
+	body := tview.NewFlex().
+		AddItem(t.messages, 0, 1, false).
+		AddItem(t.members, 24, 0, false)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(body, 0, 1, false).
+		AddItem(t.typing, 1, 0, false).
+		AddItem(t.input, 1, 0, true).
+		AddItem(t.status, 1, 0, false)
+	t.app.SetRoot(layout, true).SetFocus(t.input)
+	return t
+}
+
+// Run blocks until the user quits or Stop is called.
+func (t *chatTUI) Run() error {
+	go t.pump()
+	err := t.app.Run()
+	close(t.done)
+	return err
+}
+
+func (t *chatTUI) pump() {
+	for {
+		select {
+		case f := <-t.updates:
+			t.app.QueueUpdateDraw(f)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// queue runs f on the event loop and redraws the screen afterwards.
+func (t *chatTUI) queue(f func()) {
+	select {
+	case t.updates <- f:
+	case <-t.done:
+	}
+}
+
+func (t *chatTUI) Stop() {
+	t.app.Stop()
+}
+
+// remember adds a submitted line to the input history.
+func (t *chatTUI) remember(line string) {
+	if n := len(t.history); n == 0 || t.history[n-1] != line {
+		t.history = append(t.history, line)
+		if len(t.history) > tuiHistorySize {
+			t.history = t.history[1:]
+		}
+	}
+	t.historyPos = len(t.history)
+	t.draft = ""
+}
+
+// recall moves through the input history, keeping whatever was typed before as the newest entry.
+func (t *chatTUI) recall(delta int) {
+	pos := t.historyPos + delta
+	if pos < 0 || pos > len(t.history) {
+		return
+	}
+	if t.historyPos == len(t.history) {
+		t.draft = t.input.GetText()
+	}
+	t.historyPos = pos
+	if pos == len(t.history) {
+		t.input.SetText(t.draft)
+	} else {
+		t.input.SetText(t.history[pos])
+	}
+}
+
+// AddMessage appends a chat message to the scrollback pane.
+func (t *chatTUI) AddMessage(msg *pb.ReceiveResponse) {
+	t.queue(func() {
+		cm := msg.ChatMessage
+		ts := cm.Timestamp.AsTime().Local()
+		if cm.Recipient != "" {
+			fmt.Fprintf(t.messages, "[gray]%s [%d][-] [fuchsia]%s → %s[-]: %s\n", ts.Format("15:04:05"), cm.Id, tview.Escape(cm.Author), tview.Escape(cm.Recipient), tview.Escape(describe(cm)))
+			return
+		}
+		if cm.ParentId != 0 {
+			fmt.Fprintf(t.messages, "[gray]%s [%d][-]   [gray]↳ re [%d][-] [yellow]%s[-]: %s\n", ts.Format("15:04:05"), cm.Id, cm.ParentId, tview.Escape(cm.Author), tview.Escape(describe(cm)))
+			return
+		}
+		fmt.Fprintf(t.messages, "[gray]%s [%d][-] [yellow]%s[-]: %s\n", ts.Format("15:04:05"), cm.Id, tview.Escape(cm.Author), tview.Escape(describe(cm)))
+		// the ids are what /download needs
+		for _, attachment := range cm.Attachments {
+			fmt.Fprintf(t.messages, "[gray]           attachment %s: %s[-]\n", tview.Escape(attachmentName(attachment)), attachment.Id)
+		}
+	})
+}
+
+// AddEvent appends something that happened in the room, e.g. a member joining, to the scrollback pane.
+func (t *chatTUI) AddEvent(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	t.queue(func() {
+		fmt.Fprintf(t.messages, "[gray]%s * %s[-]\n", time.Now().Format("15:04:05"), tview.Escape(text))
+	})
+}
+
+// AddSystem appends a notice from the client itself, e.g. an error, to the scrollback pane.
+func (t *chatTUI) AddSystem(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	t.queue(func() {
+		fmt.Fprintf(t.messages, "[gray]%s[-] [red]*** %s[-]\n", time.Now().Format("15:04:05"), tview.Escape(text))
+	})
+}
+
+// SetStatus sets a field of the status bar, fields are shown sorted by key.
+func (t *chatTUI) SetStatus(key, value string) {
+	t.queue(func() {
+		t.statusInfo[key] = value
+		keys := make([]string, 0, len(t.statusInfo))
+		for k := range t.statusInfo {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s: [white::b]%s[-::-]", k, tview.Escape(t.statusInfo[k])))
+		}
+		t.status.SetText(" " + strings.Join(parts, " | "))
+	})
+}
+
+// SetMembers replaces the list of members of the room.
+func (t *chatTUI) SetMembers(names []string) {
+	t.queue(func() {
+		t.online = map[string]bool{}
+		for _, name := range names {
+			t.online[name] = true
+		}
+		t.renderMembers()
+	})
+}
+
+// SetOnline adds or removes a member of the room.
+func (t *chatTUI) SetOnline(name string, online bool) {
+	t.queue(func() {
+		if online {
+			t.online[name] = true
+		} else {
+			delete(t.online, name)
+		}
+		t.renderMembers()
+	})
+}
+
+// SetTyping shows or hides that a member is typing.
+func (t *chatTUI) SetTyping(name string, typing bool) {
+	t.queue(func() {
+		if typing {
+			t.typers[name] = true
+		} else {
+			delete(t.typers, name)
+		}
+		t.renderTyping()
+	})
+}
+
+// ClearTyping hides everyone typing, e.g. because the events stopping it may have been missed.
+func (t *chatTUI) ClearTyping() {
+	t.queue(func() {
+		t.typers = map[string]bool{}
+		t.renderTyping()
+	})
+}
+
+func (t *chatTUI) renderTyping() {
+	names := make([]string, 0, len(t.typers))
+	for name := range t.typers {
+		names = append(names, tview.Escape(name))
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		t.typing.SetText("")
+	case 1:
+		t.typing.SetText(fmt.Sprintf("[gray]%s is typing…[-]", names[0]))
+	case 2, 3:
+		t.typing.SetText(fmt.Sprintf("[gray]%s and %s are typing…[-]", strings.Join(names[:len(names)-1], ", "), names[len(names)-1]))
+	default:
+		t.typing.SetText("[gray]several people are typing…[-]")
+	}
+}
+
+func (t *chatTUI) renderMembers() {
+	names := make([]string, 0, len(t.online))
+	for name := range t.online {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "[green]●[-] %s\n", tview.Escape(name))
+	}
+	t.members.SetText(b.String())
+}
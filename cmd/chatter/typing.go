@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// typingState tracks who is typing in a room. Entries expire unless they're refreshed, so a client going away in the
+// middle of a sentence doesn't leave everyone else waiting.
+type typingState struct {
+	mu    sync.Mutex
+	until map[memberKey]time.Time
+}
+
+func newTypingState() *typingState {
+	return &typingState{until: map[memberKey]time.Time{}}
+}
+
+// set starts, refreshes or stops typing of a member and tells whether that changed whether it's typing.
+func (t *typingState) set(key memberKey, typing bool, until time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, wasTyping := t.until[key]
+	if typing {
+		t.until[key] = until
+	} else {
+		delete(t.until, key)
+	}
+	return wasTyping != typing
+}
+
+// stopUser stops typing of a user under all its display names and returns the members which were typing.
+func (t *typingState) stopUser(user string) []memberKey {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var stopped []memberKey
+	for key := range t.until {
+		if key.user == user {
+			delete(t.until, key)
+			stopped = append(stopped, key)
+		}
+	}
+	return stopped
+}
+
+// expire removes and returns the members whose typing wasn't refreshed in time.
+func (t *typingState) expire(now time.Time) []memberKey {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []memberKey
+	for key, until := range t.until {
+		if now.After(until) {
+			delete(t.until, key)
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// walSyncMode controls when the write-ahead log calls fsync on the active segment.
+type walSyncMode string
+
+const (
+	walSyncAlways   walSyncMode = "always"   // fsync after every append
+	walSyncInterval walSyncMode = "interval" // fsync periodically in the background
+	walSyncNever    walSyncMode = "never"    // leave flushing to the operating system
+)
+
+const (
+	walSegmentSuffix = ".wal"
+	walHeaderSize    = 8 // 4 bytes payload length + 4 bytes crc32 of the payload
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is an append-only log split into segment files. Every record gets a monotonically increasing index, starting at 1.
+// Segment files are named after the index of their first record, which makes locating a record a binary search over
+// file names.
+type wal struct {
+	dir          string
+	segmentSize  int64
+	syncMode     walSyncMode
+	syncInterval time.Duration
+
+	mu        sync.RWMutex
+	segments  []uint64 // first index of every segment, in ascending order
+	active    *os.File
+	activeLen int64
+	lastIndex uint64
+	dirty     bool
+	failed    error // set when a failed write couldn't be rolled back, appends are refused from then on
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func openWAL(dir string, segmentSize int64, syncMode walSyncMode, syncInterval time.Duration) (*wal, error) {
+	switch syncMode {
+	case walSyncAlways, walSyncInterval, walSyncNever:
+	default:
+		return nil, fmt.Errorf("unknown wal sync mode: %s", syncMode)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	w := &wal{
+		dir:          dir,
+		segmentSize:  segmentSize,
+		syncMode:     syncMode,
+		syncInterval: syncInterval,
+		done:         make(chan struct{}),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wal directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, first)
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i] < w.segments[j] })
+
+	if len(w.segments) == 0 {
+		if err := w.createSegment(1); err != nil {
+			return nil, err
+		}
+	} else if err := w.recoverLastSegment(); err != nil {
+		return nil, err
+	}
+
+	if syncMode == walSyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// recoverLastSegment opens the newest segment for appending. A torn record at the tail, left behind by a crash in the
+// middle of a write, is truncated away.
+func (w *wal) recoverLastSegment() error {
+	first := w.segments[len(w.segments)-1]
+	f, err := os.OpenFile(w.segmentPath(first), os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	var count uint64
+	validLen, _, err := scanSegment(f, func([]byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to scan wal segment %d: %w", first, err)
+	}
+	if err := f.Truncate(validLen); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate wal segment %d: %w", first, err)
+	}
+	if _, err := f.Seek(validLen, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to seek wal segment %d: %w", first, err)
+	}
+	w.active = f
+	w.activeLen = validLen
+	w.lastIndex = first + count - 1
+	return nil
+}
+
+func (w *wal) createSegment(first uint64) error {
+	f, err := os.OpenFile(w.segmentPath(first), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+	if w.active != nil {
+		if err := w.active.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to sync wal segment: %w", err)
+		}
+		w.active.Close()
+	}
+	w.segments = append(w.segments, first)
+	w.active = f
+	w.activeLen = 0
+	w.lastIndex = first - 1
+	return nil
+}
+
+func (w *wal) segmentPath(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, walSegmentSuffix))
+}
+
+// Append writes a record to the log and returns its index.
+func (w *wal) Append(data []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active == nil {
+		return 0, errors.New("wal is closed")
+	}
+	if w.failed != nil {
+		return 0, w.failed
+	}
+	if w.activeLen > 0 && w.activeLen+walHeaderSize+int64(len(data)) > w.segmentSize {
+		if err := w.createSegment(w.lastIndex + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[walHeaderSize:], data)
+	if _, err := w.active.Write(buf); err != nil {
+		// a partial record would end the log for every record appended after it, so it's cut off again
+		if rollbackErr := w.rollback(); rollbackErr != nil {
+			w.failed = fmt.Errorf("wal is unusable after a failed write: %w", rollbackErr)
+		}
+		return 0, fmt.Errorf("failed to write wal record: %w", err)
+	}
+	w.activeLen += int64(len(buf))
+	w.lastIndex++
+
+	switch w.syncMode {
+	case walSyncAlways:
+		if err := w.active.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync wal segment: %w", err)
+		}
+	case walSyncInterval:
+		w.dirty = true
+	}
+	return w.lastIndex, nil
+}
+
+// rollback removes whatever a failed write left behind the last complete record of the active segment.
+func (w *wal) rollback() error {
+	if err := w.active.Truncate(w.activeLen); err != nil {
+		return fmt.Errorf("failed to truncate wal segment: %w", err)
+	}
+	if _, err := w.active.Seek(w.activeLen, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek wal segment: %w", err)
+	}
+	return nil
+}
+
+// LastIndex returns the index of the newest record, or 0 if the log is empty.
+func (w *wal) LastIndex() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastIndex
+}
+
+// ReadFrom calls fn for every record with an index greater than or equal to from, in order. Records appended while
+// ReadFrom is running are not visited.
+func (w *wal) ReadFrom(from uint64, fn func(index uint64, data []byte) error) error {
+	w.mu.RLock()
+	last := w.lastIndex
+	segments := make([]uint64, len(w.segments))
+	copy(segments, w.segments)
+	w.mu.RUnlock()
+
+	if from == 0 {
+		from = 1
+	}
+	if from > last {
+		return nil
+	}
+	// find the last segment starting at or before from
+	start := sort.Search(len(segments), func(i int) bool { return segments[i] > from }) - 1
+	if start < 0 {
+		start = 0
+	}
+
+	errStop := errors.New("stop")
+	for _, first := range segments[start:] {
+		f, err := os.Open(w.segmentPath(first))
+		if err != nil {
+			return fmt.Errorf("failed to open wal segment %d: %w", first, err)
+		}
+		index := first
+		_, complete, err := scanSegment(f, func(data []byte) error {
+			defer func() { index++ }()
+			if index > last {
+				return errStop
+			}
+			if index < from {
+				return nil
+			}
+			return fn(index, data)
+		})
+		f.Close()
+		if errors.Is(err, errStop) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if index > last {
+			return nil
+		}
+		if !complete {
+			// only the tail of the newest segment may be torn, and it's truncated away when the log is opened
+			return fmt.Errorf("corrupt record %d in wal segment %d", index, first)
+		}
+	}
+	return nil
+}
+
+// scanSegment reads records from the beginning of a segment until the end of the file or the first corrupt record,
+// and returns the length of the valid prefix. complete is false if it stopped at a corrupt or torn record rather than
+// the end of the file.
+func scanSegment(f *os.File, fn func(data []byte) error) (validLen int64, complete bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if offset == info.Size() {
+			return offset, true, nil
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return offset, false, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		// the length comes from disk, a corrupt one mustn't make us allocate more than the file holds
+		if int64(size) > info.Size()-offset-walHeaderSize {
+			return offset, false, nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return offset, false, nil
+		}
+		if crc32.Checksum(data, crcTable) != sum {
+			return offset, false, nil
+		}
+		if err := fn(data); err != nil {
+			return offset, false, err
+		}
+		offset += walHeaderSize + int64(size)
+	}
+}
+
+func (w *wal) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && w.active != nil {
+				_ = w.active.Sync()
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close flushes the active segment to disk and releases it.
+func (w *wal) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active == nil {
+		return nil
+	}
+	err := w.active.Sync()
+	if cerr := w.active.Close(); err == nil {
+		err = cerr
+	}
+	w.active = nil
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestWAL(t *testing.T, dir string, segmentSize int64) *wal {
+	t.Helper()
+	w, err := openWAL(dir, segmentSize, walSyncNever, time.Second)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+	return w
+}
+
+func appendRecords(t *testing.T, w *wal, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		index, err := w.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatalf("failed to append record %d: %v", i, err)
+		}
+		if index != uint64(i) {
+			t.Fatalf("record %d got index %d", i, index)
+		}
+	}
+}
+
+// readRecords returns the records from index from on, checking they are the ones appendRecords wrote.
+func readRecords(t *testing.T, w *wal, from uint64) int {
+	t.Helper()
+	count := 0
+	err := w.ReadFrom(from, func(index uint64, data []byte) error {
+		if want := fmt.Sprintf("record %d", index); string(data) != want {
+			t.Errorf("record %d is %q, want %q", index, data, want)
+		}
+		if index != from+uint64(count) {
+			t.Errorf("got record %d, want %d", index, from+uint64(count))
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read wal: %v", err)
+	}
+	return count
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendRecords(t, w, 1, 10)
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close wal: %v", err)
+	}
+
+	w = openTestWAL(t, dir, 1<<20)
+	defer w.Close()
+	if last := w.LastIndex(); last != 10 {
+		t.Fatalf("last index after reopening is %d, want 10", last)
+	}
+	appendRecords(t, w, 11, 15)
+	if n := readRecords(t, w, 1); n != 15 {
+		t.Fatalf("read %d records, want 15", n)
+	}
+	if n := readRecords(t, w, 12); n != 4 {
+		t.Fatalf("read %d records from 12, want 4", n)
+	}
+}
+
+func TestWALRotation(t *testing.T) {
+	dir := t.TempDir()
+	// every record takes 8 bytes of header and 8 or 9 bytes of data, so a segment holds 3 of them
+	w := openTestWAL(t, dir, 60)
+	appendRecords(t, w, 1, 20)
+	if files := segmentFiles(t, dir); len(files) < 6 {
+		t.Fatalf("got %d segments, want at least 6", len(files))
+	}
+	// reads starting in the middle of a segment and at the start of one
+	for _, from := range []uint64{1, 2, 4, 7, 20} {
+		if n := readRecords(t, w, from); n != int(21-from) {
+			t.Fatalf("read %d records from %d, want %d", n, from, 21-from)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, dir, 60)
+	defer w.Close()
+	if last := w.LastIndex(); last != 20 {
+		t.Fatalf("last index after reopening is %d, want 20", last)
+	}
+	appendRecords(t, w, 21, 22)
+	if n := readRecords(t, w, 1); n != 22 {
+		t.Fatalf("read %d records, want 22", n)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	for name, tail := range map[string][]byte{
+		"partial header": {0, 0},
+		"partial record": append(binary.BigEndian.AppendUint32(nil, 100), 0, 0, 0, 0, 'x'),
+		// a corrupt length mustn't be trusted for allocating the record
+		"huge length":  append(binary.BigEndian.AppendUint32(nil, 0xffffffff), 0, 0, 0, 0, 'x'),
+		"bad checksum": append(binary.BigEndian.AppendUint32(nil, 1), 0, 0, 0, 0, 'x'),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openTestWAL(t, dir, 1<<20)
+			appendRecords(t, w, 1, 3)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			path := segmentFiles(t, dir)[0]
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			w = openTestWAL(t, dir, 1<<20)
+			defer w.Close()
+			if last := w.LastIndex(); last != 3 {
+				t.Fatalf("last index after recovery is %d, want 3", last)
+			}
+			if truncated, err := os.Stat(path); err != nil || truncated.Size() != info.Size() {
+				t.Fatalf("torn tail wasn't truncated: %v", err)
+			}
+			appendRecords(t, w, 4, 5)
+			if n := readRecords(t, w, 1); n != 5 {
+				t.Fatalf("read %d records, want 5", n)
+			}
+		})
+	}
+}
+
+func TestWALCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 60)
+	appendRecords(t, w, 1, 9)
+	defer w.Close()
+
+	// damage the payload of the second record of the first segment
+	path := segmentFiles(t, dir)[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[walHeaderSize+len("record 1")+walHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.ReadFrom(1, func(uint64, []byte) error { return nil })
+	if err == nil {
+		t.Fatal("reading a corrupt segment which isn't the last one succeeded")
+	}
+}
+
+func TestWALRollsBackFailedWrites(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendRecords(t, w, 1, 2)
+
+	// a write which stopped halfway left part of a record behind
+	if _, err := w.active.Write([]byte{0, 0, 0, 42, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, 3, 4)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, dir, 1<<20)
+	defer w.Close()
+	if n := readRecords(t, w, 1); n != 4 {
+		t.Fatalf("read %d records after reopening, want 4", n)
+	}
+}
+
+func TestWALRefusesAppendsAfterFailedRollback(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendRecords(t, w, 1, 2)
+
+	// neither writing to nor truncating a read-only file works
+	active := w.active
+	readOnly, err := os.Open(active.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.active = readOnly
+	if _, err := w.Append([]byte("record 3")); err == nil {
+		t.Fatal("append to a read-only segment succeeded")
+	}
+	w.active = active
+	readOnly.Close()
+	if _, err := w.Append([]byte("record 3")); err == nil {
+		t.Fatal("append succeeded after a write which couldn't be rolled back")
+	}
+	if last := w.LastIndex(); last != 2 {
+		t.Fatalf("last index is %d, want 2", last)
+	}
+	w.Close()
+}